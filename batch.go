@@ -0,0 +1,97 @@
+//
+// batch.go: Multi-buffer Poly1305.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"crypto/subtle"
+	"errors"
+)
+
+// batchLanes is the number of messages that SumBatch processes at once.
+const batchLanes = 4
+
+// ErrBatchLengthMismatch is the value SumBatch and VerifyBatch panic() with
+// when their arguments are not all the same length.
+var ErrBatchLengthMismatch = errors.New("poly1305: mismatched batch lengths")
+
+// SumBatch computes the MAC of each msgs[i] under keys[i], and stores it in
+// macs[i].  The result is identical to calling Sum for each message.  When
+// the backend supports it (currently avx2), groups of 4 messages are
+// processed at once, with a message per SIMD lane, up to the length of the
+// shortest message of the group, so batches work best with messages of
+// similar lengths.  Otherwise, SumBatch is equivalent to calling Sum in a
+// loop.
+func SumBatch(macs []*[Size]byte, msgs [][]byte, keys []*[KeySize]byte) {
+	if len(msgs) != len(macs) || len(keys) != len(macs) {
+		panic(ErrBatchLengthMismatch)
+	}
+	requireSelfTest()
+
+	var lanes [batchLanes]Poly1305
+	for len(macs) > 0 {
+		n := min(len(macs), batchLanes)
+		sumGroup(&lanes, macs[:n], msgs[:n], keys[:n], reuseRoleTag)
+		macs, msgs, keys = macs[n:], msgs[n:], keys[n:]
+	}
+}
+
+// VerifyBatch verifies each macs[i] against msgs[i] under keys[i], the same
+// way as SumBatch computes them.  It returns a bitmap, with bit i % 64 of
+// results[i / 64] set iff macs[i] is valid, and ok set iff every MAC is
+// valid.  Every MAC is verified, and the time taken only depends on the
+// number and lengths of the messages, and not on which MACs are valid.
+func VerifyBatch(macs []*[Size]byte, msgs [][]byte, keys []*[KeySize]byte) (results []uint64, ok bool) {
+	if len(msgs) != len(macs) || len(keys) != len(macs) {
+		panic(ErrBatchLengthMismatch)
+	}
+	requireSelfTest()
+
+	results = make([]uint64, (len(macs)+63)/64)
+	valid := 1
+
+	var lanes [batchLanes]Poly1305
+	var tags [batchLanes][Size]byte
+	var tagPtrs [batchLanes]*[Size]byte
+	for i := range tags {
+		tagPtrs[i] = &tags[i]
+	}
+	for off := 0; off < len(macs); off += batchLanes {
+		n := min(len(macs)-off, batchLanes)
+		sumGroup(&lanes, tagPtrs[:n], msgs[off:off+n], keys[off:off+n], reuseRoleVerify)
+		for i := 0; i < n; i++ {
+			v := subtle.ConstantTimeCompare(macs[off+i][:], tags[i][:])
+			results[(off+i)/64] |= uint64(v) << ((off + i) % 64)
+			valid &= v
+		}
+	}
+	for i := range tags {
+		tags[i] = [Size]byte{}
+	}
+
+	return results, valid == 1
+}
+
+// sumGroup computes the MACs of up to batchLanes messages, using lanes as
+// scratch space that is purged before returning.
+func sumGroup(lanes *[batchLanes]Poly1305, macs []*[Size]byte, msgs [][]byte, keys []*[KeySize]byte, role byte) {
+	n := len(macs)
+	for i := 0; i < n; i++ {
+		checkKeyReuse(role, keys[i][:])
+		lanes[i].rekey(keys[i][:])
+	}
+
+	var off int
+	if n == batchLanes {
+		off = blocksBatch(lanes, msgs)
+	}
+	for i := 0; i < n; i++ {
+		lanes[i].Write(msgs[i][off:])
+		lanes[i].finish(macs[i])
+	}
+}
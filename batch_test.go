@@ -0,0 +1,251 @@
+//
+// batch_test.go: Multi-buffer Poly1305 tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newBatch(rng *rand.Rand, n, maxLen int) ([]*[Size]byte, [][]byte, []*[KeySize]byte) {
+	macs := make([]*[Size]byte, n)
+	msgs := make([][]byte, n)
+	keys := make([]*[KeySize]byte, n)
+	for i := range macs {
+		macs[i] = new([Size]byte)
+		msgs[i] = make([]byte, rng.IntN(maxLen+1))
+		for j := range msgs[i] {
+			msgs[i][j] = byte(rng.Uint32())
+		}
+		keys[i] = new([KeySize]byte)
+		for j := range keys[i] {
+			keys[i][j] = byte(rng.Uint32())
+		}
+	}
+	return macs, msgs, keys
+}
+
+func TestSumBatch(t *testing.T) {
+	disableReuseDetector(t)
+	defer func(impl *implementation) {
+		activeImpl.Store(impl)
+	}(activeImpl.Load())
+
+	rng := rand.New(rand.NewPCG(1305, 21))
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			if !impl.supported {
+				t.Skipf("%s is not supported by the host", impl.name)
+			}
+			activeImpl.Store(impl)
+
+			for iter := 0; iter < 100; iter++ {
+				maxLen := []int{0, 16, 64, 300, 2048}[iter%5]
+				macs, msgs, keys := newBatch(rng, rng.IntN(3*batchLanes), maxLen)
+				SumBatch(macs, msgs, keys)
+				for i := range macs {
+					var expected [Size]byte
+					Sum(&expected, msgs[i], keys[i])
+					if *macs[i] != expected {
+						t.Fatalf("[%d]: SumBatch()[%d] (%d bytes) != Sum()", iter, i, len(msgs[i]))
+					}
+				}
+			}
+		})
+	}
+
+	func() {
+		defer func() {
+			if err := recover(); err != ErrBatchLengthMismatch {
+				t.Errorf("SumBatch(): mismatched lengths, recover() = %v", err)
+			}
+		}()
+		SumBatch(make([]*[Size]byte, 2), make([][]byte, 1), make([]*[KeySize]byte, 2))
+	}()
+}
+
+func TestVerifyBatch(t *testing.T) {
+	disableReuseDetector(t)
+
+	n := len(selfTestVectors)
+	macs := make([]*[Size]byte, n)
+	msgs := make([][]byte, n)
+	keys := make([]*[KeySize]byte, n)
+	for i := range selfTestVectors {
+		vec := &selfTestVectors[i]
+		tag := vec.mac
+		macs[i], msgs[i], keys[i] = &tag, vec.m, &vec.key
+	}
+	allValid := uint64(1)<<n - 1
+
+	results, ok := VerifyBatch(macs, msgs, keys)
+	if !ok || len(results) != 1 || results[0] != allValid {
+		t.Fatalf("VerifyBatch(selfTestVectors): %x, %v", results, ok)
+	}
+
+	// Corrupt each tag in turn, and every tag at once.
+	for i := range macs {
+		macs[i][i%Size] ^= 0x80
+		results, ok = VerifyBatch(macs, msgs, keys)
+		if ok || results[0] != allValid&^(1<<i) {
+			t.Errorf("[%d]: VerifyBatch(corrupted tag): %x, %v", i, results, ok)
+		}
+		macs[i][i%Size] ^= 0x80
+	}
+	for i := range macs {
+		macs[i][0] ^= 1
+	}
+	results, ok = VerifyBatch(macs, msgs, keys)
+	if ok || results[0] != 0 {
+		t.Errorf("VerifyBatch(all corrupted): %x, %v", results, ok)
+	}
+
+	// A batch spanning several bitmap words, and the AVX2 kernel.
+	rng := rand.New(rand.NewPCG(1305, 22))
+	macs, msgs, keys = newBatch(rng, 150, 300)
+	SumBatch(macs, msgs, keys)
+	expected := make([]uint64, 3)
+	for i := range macs {
+		if rng.IntN(4) == 0 {
+			macs[i][rng.IntN(Size)] ^= 1 << rng.IntN(8)
+		} else {
+			expected[i/64] |= 1 << (i % 64)
+		}
+	}
+	results, ok = VerifyBatch(macs, msgs, keys)
+	if ok || !slices.Equal(results, expected) {
+		t.Errorf("VerifyBatch(random): %x != %x, %v", results, expected, ok)
+	}
+
+	if results, ok = VerifyBatch(nil, nil, nil); !ok || len(results) != 0 {
+		t.Errorf("VerifyBatch(nil): %x, %v", results, ok)
+	}
+}
+
+// TestVerifyBatchComparesEveryItem checks that VerifyBatch compares every
+// tag, without stopping at the first mismatch, with a single mismatch, and
+// a single match, at every position of a batch spanning several bitmap
+// words.
+func TestVerifyBatchComparesEveryItem(t *testing.T) {
+	disableReuseDetector(t)
+
+	const n = 150
+
+	rng := rand.New(rand.NewPCG(1305, 23))
+	macs, msgs, keys := newBatch(rng, n, 300)
+	SumBatch(macs, msgs, keys)
+	bad := make([]*[Size]byte, n)
+	for i := range bad {
+		tag := *macs[i]
+		tag[i%Size] ^= 0x01
+		bad[i] = &tag
+	}
+
+	allValid := make([]uint64, (n+63)/64)
+	for i := 0; i < n; i++ {
+		allValid[i/64] |= 1 << (i % 64)
+	}
+	for i := 0; i < n; i++ {
+		oneBad := slices.Clone(macs)
+		oneBad[i] = bad[i]
+		expected := slices.Clone(allValid)
+		expected[i/64] &^= 1 << (i % 64)
+		if results, ok := VerifyBatch(oneBad, msgs, keys); ok || !slices.Equal(results, expected) {
+			t.Errorf("[%d]: VerifyBatch(one mismatch): %x != %x, %v", i, results, expected, ok)
+		}
+
+		oneGood := slices.Clone(bad)
+		oneGood[i] = macs[i]
+		expected = make([]uint64, len(allValid))
+		expected[i/64] = 1 << (i % 64)
+		if results, ok := VerifyBatch(oneGood, msgs, keys); ok || !slices.Equal(results, expected) {
+			t.Errorf("[%d]: VerifyBatch(one match): %x != %x, %v", i, results, expected, ok)
+		}
+	}
+}
+
+func TestVerifyBatchTiming(t *testing.T) {
+	// Wall clock measurements are too noisy on loaded or emulated hosts to
+	// run by default.
+	if os.Getenv("POLY1305_TIMING_TESTS") != "1" {
+		t.Skip("skipping timing test, set POLY1305_TIMING_TESTS=1 to run it")
+	}
+
+	const (
+		n     = 256
+		iters = 200
+	)
+	rng := rand.New(rand.NewPCG(1305, 22))
+	macs, msgs, keys := newBatch(rng, n, 0)
+	for i := range msgs {
+		msgs[i] = make([]byte, 64)
+	}
+	SumBatch(macs, msgs, keys)
+	bad := make([]*[Size]byte, n)
+	for i := range bad {
+		tag := *macs[i]
+		tag[0] ^= 1
+		bad[i] = &tag
+	}
+	firstBad := slices.Clone(macs)
+	firstBad[0] = bad[0]
+	lastBad := slices.Clone(macs)
+	lastBad[n-1] = bad[n-1]
+
+	// The minimum of many interleaved runs is the least noisy estimate of
+	// the time each case takes.
+	cases := [][]*[Size]byte{macs, bad, firstBad, lastBad}
+	best := make([]time.Duration, len(cases))
+	for i := range best {
+		best[i] = time.Duration(1<<63 - 1)
+	}
+	for iter := 0; iter < iters; iter++ {
+		for i, c := range cases {
+			start := time.Now()
+			VerifyBatch(c, msgs, keys)
+			best[i] = min(best[i], time.Since(start))
+		}
+	}
+
+	lo, hi := slices.Min(best), slices.Max(best)
+	if float64(hi) > 1.25*float64(lo) {
+		t.Errorf("VerifyBatch() timing depends on validity: %v", best)
+	}
+}
+
+func BenchmarkSumBatch(b *testing.B) {
+	const n = 64
+
+	rng := rand.New(rand.NewPCG(1305, 21))
+	for _, l := range []int{64, 256, 1024} {
+		macs, msgs, keys := newBatch(rng, n, 0)
+		for i := range msgs {
+			msgs[i] = make([]byte, l)
+		}
+
+		b.Run(strconv.Itoa(l), func(b *testing.B) {
+			b.SetBytes(int64(n * l))
+			for i := 0; i < b.N; i++ {
+				SumBatch(macs, msgs, keys)
+			}
+		})
+		b.Run(strconv.Itoa(l)+"/Sum", func(b *testing.B) {
+			b.SetBytes(int64(n * l))
+			for i := 0; i < b.N; i++ {
+				for j := range macs {
+					Sum(macs[j], msgs[j], keys[j])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+//
+// combine.go: Poly1305 segment combining.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+
+	"github.com/Yawning/poly1305/internal/field"
+)
+
+var (
+	// ErrKeyMismatch is the error returned when combining Partials computed
+	// under different keys.
+	ErrKeyMismatch = errors.New("poly1305: partials computed under different keys")
+
+	// ErrUnalignedSegment is the error returned when combining a Partial that
+	// is not a multiple of BlockSize bytes with a following segment.
+	ErrUnalignedSegment = errors.New("poly1305: segment is not block aligned")
+)
+
+// Partial is the intermediate MAC state of one segment of a message, that
+// can be merged with the Partials of the adjacent segments computed under
+// the same key via Combine.  Every segment except the last must be a
+// multiple of BlockSize bytes long.
+//
+// The MAC of the whole message is the MAC of the combination of all of the
+// segments.  Since Poly1305 keys are one time use only, the Partials of a
+// given key must all be segments of the same message.  Like the key itself,
+// Partials must be kept secret.
+type Partial struct {
+	st     Poly1305
+	length uint64
+}
+
+// NewPartial returns a new Partial, keyed with the supplied key.
+func NewPartial(key []byte) (*Partial, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKeySize
+	}
+	if err := checkSelfTest(); err != nil {
+		return nil, err
+	}
+
+	// Every segment uses the same key, so bypass the key reuse detector.
+	p := &Partial{}
+	p.st.rekey(key)
+	return p, nil
+}
+
+// Write adds more data to the segment.  It never returns an error.
+func (p *Partial) Write(b []byte) (n int, err error) {
+	p.st.update(b)
+	p.length += uint64(len(b))
+	return len(b), nil
+}
+
+// Len returns the length of the segment in bytes.
+func (p *Partial) Len() uint64 {
+	return p.length
+}
+
+// SumTo writes the MAC of the segment to out, as if the segment was the
+// whole message.  It does not change the segment's state.
+func (p *Partial) SumTo(out *[Size]byte) {
+	p.st.SumTo(out)
+}
+
+// Clear purges the sensitive material in the segment's state.
+func (p *Partial) Clear() {
+	p.st.Clear()
+	p.length = 0
+}
+
+// Combine returns the Partial of the concatenation of the left and right
+// segments, which must have been computed under the same key.  The left
+// segment must be a multiple of BlockSize bytes long.  Neither left nor
+// right are modified.
+func Combine(left, right *Partial) (*Partial, error) {
+	lImpl, rImpl := &left.st.impl, &right.st.impl
+	keyEq := lImpl.r.Equal(&rImpl.r)
+	keyEq &= subtle.ConstantTimeCompare(limbBytes(lImpl.pad[:]), limbBytes(rImpl.pad[:]))
+	if keyEq != 1 {
+		return nil, ErrKeyMismatch
+	}
+	if left.st.leftover != 0 {
+		return nil, ErrUnalignedSegment
+	}
+
+	// h(A || B) = h(A) * r^blocks(B) + h(B)
+	p := &Partial{
+		st:     right.st,
+		length: left.length + right.length,
+	}
+	var rPow field.Element
+	rPow.Pow(&rImpl.r, right.length/BlockSize)
+	lH, rH := lImpl.hElement(), rImpl.hElement()
+	p.st.impl.unpack64()
+	p.st.impl.h.Mul(&lH, &rPow).Add(&p.st.impl.h, &rH)
+	return p, nil
+}
+
+// MarshalBinary returns the serialized segment state.  Like the Partial
+// itself, the serialized state must be kept secret.
+func (p *Partial) MarshalBinary() ([]byte, error) {
+	b, err := p.st.AppendBinary(make([]byte, 0, stateSize+8))
+	if err != nil {
+		return nil, err
+	}
+	return binary.LittleEndian.AppendUint64(b, p.length), nil
+}
+
+// UnmarshalBinary restores the segment state from a serialized state
+// produced by MarshalBinary.
+func (p *Partial) UnmarshalBinary(b []byte) error {
+	if len(b) != stateSize+8 {
+		return ErrStateTruncated
+	}
+
+	if err := checkSelfTest(); err != nil {
+		return err
+	}
+
+	// Every segment uses the same key, so bypass the key reuse detector.
+	var tmp Partial
+	if err := tmp.st.unmarshalBinary(b[:stateSize]); err != nil {
+		return err
+	}
+	tmp.length = binary.LittleEndian.Uint64(b[stateSize:])
+	if tmp.length%BlockSize != uint64(tmp.st.leftover) {
+		return ErrStateNonCanonical
+	}
+	*p = tmp
+	return nil
+}
+
+func limbBytes(l []uint32) []byte {
+	b := make([]byte, 0, len(l)*4)
+	for _, v := range l {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+	return b
+}
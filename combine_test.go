@@ -0,0 +1,142 @@
+//
+// combine_test.go: Poly1305 segment combining tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"math/rand/v2"
+	"sort"
+	"testing"
+)
+
+func TestCombine(t *testing.T) {
+	disableReuseDetector(t)
+
+	rng := rand.New(rand.NewPCG(1305, 0))
+
+	for iter := 0; iter < 200; iter++ {
+		var key [KeySize]byte
+		for i := range key {
+			key[i] = byte(rng.Uint32())
+		}
+		m := make([]byte, rng.IntN(1024))
+		for i := range m {
+			m[i] = byte(rng.Uint32())
+		}
+		var expected [Size]byte
+		Sum(&expected, m, &key)
+
+		// Random block aligned split points, with an arbitrary last segment.
+		var splits []int
+		for i := rng.IntN(6); i > 0; i-- {
+			splits = append(splits, rng.IntN(len(m)/BlockSize+1)*BlockSize)
+		}
+		sort.Ints(splits)
+		splits = append(splits, len(m))
+
+		var parts []*Partial
+		prev := 0
+		for _, off := range splits {
+			p, err := NewPartial(key[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Write(m[prev:off])
+			parts = append(parts, p)
+			prev = off
+		}
+
+		// Fold from the left and from the right, which must agree.
+		left := parts[0]
+		for _, p := range parts[1:] {
+			var err error
+			if left, err = Combine(left, p); err != nil {
+				t.Fatalf("[%d]: Combine(): %s", iter, err)
+			}
+		}
+		right := parts[len(parts)-1]
+		for i := len(parts) - 2; i >= 0; i-- {
+			var err error
+			if right, err = Combine(parts[i], right); err != nil {
+				t.Fatalf("[%d]: Combine(): %s", iter, err)
+			}
+		}
+
+		for _, p := range []*Partial{left, right} {
+			var mac [Size]byte
+			p.SumTo(&mac)
+			if mac != expected {
+				t.Fatalf("[%d]: combined mac != Sum(m) (splits: %v)", iter, splits)
+			}
+			if p.Len() != uint64(len(m)) {
+				t.Fatalf("[%d]: p.Len(): %d (expected: %d)", iter, p.Len(), len(m))
+			}
+		}
+
+		// The combined state can be extended further.
+		suffix := []byte("suffix")
+		left.Write(suffix)
+		var mac [Size]byte
+		left.SumTo(&mac)
+		Sum(&expected, append(m, suffix...), &key)
+		if mac != expected {
+			t.Fatalf("[%d]: extended mac != Sum(m || suffix)", iter)
+		}
+	}
+}
+
+func TestCombineErrors(t *testing.T) {
+	var key [KeySize]byte
+	a, _ := NewPartial(key[:])
+	key[31] = 1
+	b, _ := NewPartial(key[:])
+	if _, err := Combine(a, b); err != ErrKeyMismatch {
+		t.Errorf("Combine(different keys): %v (expected: ErrKeyMismatch)", err)
+	}
+
+	c, _ := NewPartial(key[:])
+	c.Write([]byte("unaligned"))
+	if _, err := Combine(c, b); err != ErrUnalignedSegment {
+		t.Errorf("Combine(unaligned): %v (expected: ErrUnalignedSegment)", err)
+	}
+	if _, err := NewPartial(key[:1]); err != ErrInvalidKeySize {
+		t.Errorf("NewPartial(short key): %v (expected: ErrInvalidKeySize)", err)
+	}
+}
+
+func TestPartialMarshalBinary(t *testing.T) {
+	var key [KeySize]byte
+	key[0] = 0xaa
+	m := []byte("segments travel between machines")
+
+	p, _ := NewPartial(key[:])
+	p.Write(m)
+	b, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatalf("p.MarshalBinary(): %s", err)
+	}
+
+	var p2 Partial
+	if err = p2.UnmarshalBinary(b); err != nil {
+		t.Fatalf("p2.UnmarshalBinary(): %s", err)
+	}
+	var mac, expected [Size]byte
+	p2.SumTo(&mac)
+	Sum(&expected, m, &key)
+	if mac != expected || p2.Len() != uint64(len(m)) {
+		t.Errorf("restored partial != original")
+	}
+
+	b[len(b)-8]++
+	if err = p2.UnmarshalBinary(b); err != ErrStateNonCanonical {
+		t.Errorf("p2.UnmarshalBinary(bad length): %v (expected: ErrStateNonCanonical)", err)
+	}
+	if err = p2.UnmarshalBinary(b[:len(b)-1]); err != ErrStateTruncated {
+		t.Errorf("p2.UnmarshalBinary(truncated): %v (expected: ErrStateTruncated)", err)
+	}
+}
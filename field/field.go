@@ -0,0 +1,110 @@
+//
+// field.go: GF(2^130 - 5) arithmetic.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+// Package field implements constant time arithmetic over GF(2^130 - 5), the
+// field used by Poly1305.
+//
+// The implementation is the 26-bit limb arithmetic from Andrew Moon's
+// poly1305-donna-32, which is shared with the Poly1305 implementation.
+package field
+
+import "github.com/Yawning/poly1305/internal/field"
+
+// Size is the size of the canonical encoding of an Element in bytes.
+const Size = field.Size
+
+// ErrNonCanonical is the error returned when decoding a non-canonical
+// encoding of an Element.
+var ErrNonCanonical = field.ErrNonCanonical
+
+// Element is an element of GF(2^130 - 5).  The zero value is 0.  All
+// operations are constant time unless noted otherwise.
+type Element struct {
+	e field.Element
+}
+
+// Zero sets v to 0, and returns v.
+func (v *Element) Zero() *Element {
+	v.e.Zero()
+	return v
+}
+
+// One sets v to 1, and returns v.
+func (v *Element) One() *Element {
+	v.e.One()
+	return v
+}
+
+// Set sets v to a, and returns v.
+func (v *Element) Set(a *Element) *Element {
+	v.e.Set(&a.e)
+	return v
+}
+
+// SetBytes sets v to the canonical little endian encoding x, and returns v.
+// If x is not Size bytes, or is not canonical (ie: x >= 2^130 - 5), SetBytes
+// returns nil and ErrNonCanonical, and v is unchanged.
+func (v *Element) SetBytes(x []byte) (*Element, error) {
+	if _, err := v.e.SetBytes(x); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Bytes returns the canonical little endian encoding of v.
+func (v *Element) Bytes() []byte {
+	return v.e.Bytes()
+}
+
+// Equal returns 1 if v and u are equal, and 0 otherwise.
+func (v *Element) Equal(u *Element) int {
+	return v.e.Equal(&u.e)
+}
+
+// Add sets v = a + b, and returns v.
+func (v *Element) Add(a, b *Element) *Element {
+	v.e.Add(&a.e, &b.e)
+	return v
+}
+
+// Sub sets v = a - b, and returns v.
+func (v *Element) Sub(a, b *Element) *Element {
+	v.e.Sub(&a.e, &b.e)
+	return v
+}
+
+// Negate sets v = -a, and returns v.
+func (v *Element) Negate(a *Element) *Element {
+	v.e.Negate(&a.e)
+	return v
+}
+
+// Mul sets v = a * b, and returns v.
+func (v *Element) Mul(a, b *Element) *Element {
+	v.e.Mul(&a.e, &b.e)
+	return v
+}
+
+// Square sets v = a * a, and returns v.
+func (v *Element) Square(a *Element) *Element {
+	v.e.Square(&a.e)
+	return v
+}
+
+// Pow sets v = x^e, and returns v.  Pow is not constant time with respect
+// to e.
+func (v *Element) Pow(x *Element, e uint64) *Element {
+	v.e.Pow(&x.e, e)
+	return v
+}
+
+// Invert sets v = 1/x, and returns v.  If x is 0, v is set to 0.
+func (v *Element) Invert(x *Element) *Element {
+	v.e.Invert(&x.e)
+	return v
+}
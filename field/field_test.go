@@ -0,0 +1,62 @@
+//
+// field_test.go: GF(2^130 - 5) arithmetic tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package field
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The arithmetic is tested against math/big in internal/field, this only
+// checks that the wrapper is wired to it.
+func TestWrapper(t *testing.T) {
+	var b [Size]byte
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	b[Size-1] = 1
+	x, err := new(Element).SetBytes(b[:])
+	if err != nil {
+		t.Fatalf("SetBytes(): %s", err)
+	}
+	if !bytes.Equal(x.Bytes(), b[:]) {
+		t.Fatalf("Bytes() != SetBytes() input")
+	}
+
+	y := new(Element).Add(x, new(Element).One())
+	one := new(Element).One()
+	for _, vec := range []struct {
+		op       string
+		got, exp *Element
+	}{
+		{"Sub", new(Element).Sub(y, x), one},
+		{"Negate", new(Element).Add(x, new(Element).Negate(x)), new(Element).Zero()},
+		{"Square", new(Element).Square(x), new(Element).Mul(x, x)},
+		{"Pow", new(Element).Pow(x, 3), new(Element).Mul(x, new(Element).Square(x))},
+		{"Invert", new(Element).Mul(x, new(Element).Invert(x)), one},
+		{"Set", new(Element).Set(x), x},
+	} {
+		if vec.got.Equal(vec.exp) != 1 {
+			t.Errorf("%s: %x (expected: %x)", vec.op, vec.got.Bytes(), vec.exp.Bytes())
+		}
+	}
+	if x.Equal(y) != 0 {
+		t.Errorf("Equal(x, x + 1) = 1")
+	}
+
+	// 2^130 - 5 is not canonical.
+	p := [Size]byte{0xfb}
+	for i := 1; i < Size-1; i++ {
+		p[i] = 0xff
+	}
+	p[Size-1] = 3
+	if _, err := new(Element).SetBytes(p[:]); err != ErrNonCanonical {
+		t.Errorf("SetBytes(p): %v (expected: ErrNonCanonical)", err)
+	}
+}
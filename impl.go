@@ -0,0 +1,415 @@
+//
+// impl.go: Poly1305 backend selection.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/Yawning/poly1305/internal/field"
+)
+
+const (
+	// envImplementation is the environment variable that forces a backend
+	// on startup, see ForceImplementation.
+	envImplementation = "POLY1305_IMPL"
+
+	// envCrossCheck is the environment variable that enables the
+	// cross-check mode on startup, see EnableCrossCheck.
+	envCrossCheck = "POLY1305_CROSSCHECK"
+)
+
+// implState is the Poly1305 state shared by every backend.  r and h are
+// stored as field elements, so that the state can be serialized and
+// manipulated the same way no matter which backend produced it, and so that
+// the backend can change between calls.
+type implState struct {
+	r   field.Element
+	h   field.Element
+	pad [4]uint32
+
+	// rPow caches r^2, r^3 and r^4 for the backends that process several
+	// blocks at once.  Each power is zero when not computed, see power.
+	rPow [3]field.Element
+
+	// h64 and r64 are h and r as 64 bit limbs, that the mul64 based
+	// backends keep between calls.  Iff is64 is set, they hold the current
+	// values, and h is zero, see unpack64.
+	h64  [3]uint64
+	r64  [2]uint64
+	is64 bool
+}
+
+type implInterface interface {
+	init(key []byte)
+	clear()
+	blocks(m []byte, bytes int, isFinal bool)
+	finish(mac *[Size]byte)
+}
+
+// implementation is a Poly1305 backend.
+type implementation struct {
+	name string
+
+	// supported is true iff the host can run the backend.
+	supported bool
+}
+
+var (
+	// ErrUnsupportedImplementation is the error returned when forcing or
+	// cross-checking against a backend that does not exist, or that is not
+	// supported by the host.
+	ErrUnsupportedImplementation = errors.New("poly1305: unsupported implementation")
+
+	// ErrCrossCheckMismatch is the value the cross-check mode panic()s with
+	// when two backends disagree.
+	ErrCrossCheckMismatch = errors.New("poly1305: implementation cross-check mismatch")
+
+	implDonna32Impl = &implementation{name: "donna32", supported: true}
+	implMul64Impl   = &implementation{name: "mul64", supported: true}
+	implHornerImpl  = &implementation{name: "horner", supported: true}
+
+	// implementations is every backend that is compiled in, supported by
+	// the host or not.
+	implementations = append([]*implementation{
+		implDonna32Impl,
+		implMul64Impl,
+		implHornerImpl,
+	}, archImplementations...)
+
+	// activeImpl is the backend in use.
+	activeImpl atomic.Pointer[implementation]
+
+	// checkImpl is the backend that every blocks and finish call is
+	// cross-checked against, if any.
+	checkImpl atomic.Pointer[implementation]
+
+	// envErr is the error from applying the environment variables on
+	// startup, if any, see EnvironmentError.
+	envErr error
+)
+
+// Implementations returns the names of the backends that are supported by
+// the host.
+func Implementations() []string {
+	var names []string
+	for _, impl := range implementations {
+		if impl.supported {
+			names = append(names, impl.name)
+		}
+	}
+	return names
+}
+
+// Implementation returns the name of the backend in use.
+func Implementation() string {
+	return activeImpl.Load().name
+}
+
+// ForceImplementation forces the use of the named backend, or restores the
+// default backend if name is "".  As every backend shares the same state,
+// the backend may be changed while instances are in use, though this is
+// intended for testing and for reproducing bugs, and not for production.
+// The POLY1305_IMPL environment variable does the same on startup.
+func ForceImplementation(name string) error {
+	if name == "" {
+		activeImpl.Store(defaultImpl())
+		return nil
+	}
+
+	impl := lookupImpl(name)
+	if impl == nil {
+		return ErrUnsupportedImplementation
+	}
+	activeImpl.Store(impl)
+	return nil
+}
+
+// EnableCrossCheck enables the cross-check mode, in which every operation
+// also runs on the named backend, and panic()s with ErrCrossCheckMismatch
+// if the result differs from that of the backend in use.  The mode is
+// intended for debugging, and more than doubles the cost of every
+// operation.  The POLY1305_CROSSCHECK environment variable does the same on
+// startup.
+func EnableCrossCheck(name string) error {
+	impl := lookupImpl(name)
+	if impl == nil {
+		return ErrUnsupportedImplementation
+	}
+	checkImpl.Store(impl)
+	return nil
+}
+
+// DisableCrossCheck disables the cross-check mode.
+func DisableCrossCheck() {
+	checkImpl.Store(nil)
+}
+
+// EnvironmentError returns the error from applying the POLY1305_IMPL and
+// POLY1305_CROSSCHECK environment variables on startup, if any.  Invalid
+// values are ignored, leaving the default backend in use, and the
+// cross-check mode disabled.
+func EnvironmentError() error {
+	return envErr
+}
+
+func lookupImpl(name string) *implementation {
+	for _, impl := range implementations {
+		if impl.name == name && impl.supported {
+			return impl
+		}
+	}
+	return nil
+}
+
+// The dispatch is done with a switch rather than through a function
+// pointer or interface, so that escape analysis can prove that the state
+// does not escape.  horner uses the donna32 init, clear and finish, and
+// every other backend uses the mul64 ones, and only differs in blocks, which
+// is dispatched to the architecture specific backends in the
+// per-architecture files.
+
+func (impl *implState) init(key []byte) {
+	impl.initWith(activeImpl.Load(), key)
+}
+
+func (impl *implState) initWith(which *implementation, key []byte) {
+	// Invalidate the cached powers of r, and the 64 bit limbs.
+	for i := range impl.rPow {
+		impl.rPow[i].Zero()
+	}
+	impl.clear64()
+
+	switch which {
+	case implDonna32Impl, implHornerImpl:
+		(*implDonna32)(impl).init(key)
+	default:
+		(*implMul64)(impl).init(key)
+	}
+}
+
+func (impl *implState) clear() {
+	impl.clearWith(activeImpl.Load())
+}
+
+func (impl *implState) clearWith(which *implementation) {
+	impl.clear64()
+
+	switch which {
+	case implDonna32Impl, implHornerImpl:
+		(*implDonna32)(impl).clear()
+	default:
+		(*implMul64)(impl).clear()
+	}
+}
+
+func (impl *implState) blocks(m []byte, bytes int, isFinal bool) {
+	if check := checkImpl.Load(); check != nil {
+		impl.crossCheckBlocks(check, m, bytes, isFinal)
+		return
+	}
+	impl.blocksWith(activeImpl.Load(), m, bytes, isFinal)
+}
+
+func (impl *implState) blocksGeneric(which *implementation, m []byte, bytes int, isFinal bool) {
+	switch which {
+	case implDonna32Impl:
+		impl.unpack64()
+		(*implDonna32)(impl).blocks(m, bytes, isFinal)
+	case implHornerImpl:
+		impl.unpack64()
+		(*implHorner)(impl).blocks(m, bytes, isFinal)
+	default:
+		(*implMul64)(impl).blocks(m, bytes, isFinal)
+	}
+}
+
+func (impl *implState) finish(mac *[Size]byte) {
+	if check := checkImpl.Load(); check != nil {
+		impl.crossCheckFinish(check, mac)
+		return
+	}
+	impl.finishWith(activeImpl.Load(), mac)
+}
+
+func (impl *implState) finishWith(which *implementation, mac *[Size]byte) {
+	switch which {
+	case implDonna32Impl, implHornerImpl:
+		impl.unpack64()
+		(*implDonna32)(impl).finish(mac)
+	default:
+		(*implMul64)(impl).finish(mac)
+	}
+}
+
+func (impl *implState) crossCheckBlocks(check *implementation, m []byte, bytes int, isFinal bool) {
+	tmp := *impl
+	tmp.blocksWith(check, m, bytes, isFinal)
+	impl.blocksWith(activeImpl.Load(), m, bytes, isFinal)
+
+	h, tmpH := impl.hElement(), tmp.hElement()
+	ok := h.Equal(&tmpH)
+	tmp.clearWith(check)
+	h.Zero()
+	tmpH.Zero()
+	if ok != 1 {
+		panic(ErrCrossCheckMismatch)
+	}
+}
+
+func (impl *implState) crossCheckFinish(check *implementation, mac *[Size]byte) {
+	var tmp [Size]byte
+	impl.finishWith(check, &tmp)
+	impl.finishWith(activeImpl.Load(), mac)
+
+	ok := tmp == *mac
+	tmp = [Size]byte{}
+	if !ok {
+		panic(ErrCrossCheckMismatch)
+	}
+}
+
+// sumShort is the one-shot MAC of a message of at most shortMessageSize
+// bytes, which skips the buffering in Write, and the copy of the instance
+// in finish.  In the cross-check mode, the MAC is computed by both backends
+// and compared.
+func sumShort(mac *[Size]byte, m []byte, key *[KeySize]byte) {
+	if check := checkImpl.Load(); check != nil {
+		var tmp [Size]byte
+		sumShortWith(check, &tmp, m, key)
+		sumShortWith(activeImpl.Load(), mac, m, key)
+
+		ok := tmp == *mac
+		tmp = [Size]byte{}
+		if !ok {
+			panic(ErrCrossCheckMismatch)
+		}
+		return
+	}
+	sumShortWith(activeImpl.Load(), mac, m, key)
+}
+
+// sumShortWith is sumShort with a given backend.  The mul64 based backends,
+// which only differ from mul64 for long runs of blocks, use a dedicated
+// path that keeps the state in registers from the key to the MAC.
+func sumShortWith(which *implementation, mac *[Size]byte, m []byte, key *[KeySize]byte) {
+	switch which {
+	case implDonna32Impl, implHornerImpl:
+		sumWith(which, mac, m, key)
+	default:
+		sumShortMul64(mac, m, key)
+	}
+}
+
+// sumWith is the one-shot MAC of m with a given backend, on a bare
+// implState, bypassing the cross-check mode.
+func sumWith(which *implementation, mac *[Size]byte, m []byte, key *[KeySize]byte) {
+	var impl implState
+	impl.initWith(which, key[:])
+	n := len(m) &^ (BlockSize - 1)
+	if n > 0 {
+		impl.blocksWith(which, m, n, false)
+	}
+	if len(m) > n {
+		var b [BlockSize]byte
+		b[copy(b[:], m[n:])] = 1
+		impl.blocksWith(which, b[:], BlockSize, true)
+		b = [BlockSize]byte{}
+	}
+	impl.finishWith(which, mac)
+	impl.clearWith(which)
+}
+
+// unpack64 moves h from the 64 bit limbs used by the mul64 based backends
+// back to the field element, if needed, so that it can be used directly.
+func (impl *implState) unpack64() {
+	if impl.is64 {
+		impl.h = impl.hElement()
+		impl.clear64()
+	}
+}
+
+// hElement returns h as a field element, without changing the state.
+func (impl *implState) hElement() field.Element {
+	if !impl.is64 {
+		return impl.h
+	}
+
+	var h field.Element
+	store64(&h, impl.h64[0], impl.h64[1], impl.h64[2])
+	return h
+}
+
+func (impl *implState) clear64() {
+	impl.h64 = [3]uint64{}
+	impl.r64 = [2]uint64{}
+	impl.is64 = false
+}
+
+// power returns r^e for e in 1 .. 4, computing and caching it if needed.
+func (impl *implState) power(e int) *field.Element {
+	if e == 1 {
+		return &impl.r
+	}
+
+	p := &impl.rPow[e-2]
+	if *p == (field.Element{}) {
+		switch e {
+		case 2:
+			p.Square(&impl.r)
+		case 3:
+			p.Mul(impl.power(2), &impl.r)
+		case 4:
+			p.Square(impl.power(2))
+		}
+	}
+	return p
+}
+
+func defaultImpl() *implementation {
+	if impl := archDefaultImpl(); impl != nil {
+		return impl
+	}
+
+	// The 64 bit backend is only faster when bits.Mul64 is a single
+	// instruction (or close to it).  Elsewhere horner is donna32 for short
+	// messages, and faster for long ones.
+	switch runtime.GOARCH {
+	case "amd64", "arm64", "loong64", "mips64", "mips64le", "ppc64", "ppc64le", "riscv64", "s390x":
+		return implMul64Impl
+	}
+	return implHornerImpl
+}
+
+// applyEnvironment applies the POLY1305_IMPL and POLY1305_CROSSCHECK
+// environment variables, skipping the ones that are invalid.
+func applyEnvironment() error {
+	var errs []error
+	if name := os.Getenv(envImplementation); name != "" {
+		if err := ForceImplementation(name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", envImplementation, err))
+		}
+	}
+	if name := os.Getenv(envCrossCheck); name != "" {
+		if err := EnableCrossCheck(name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", envCrossCheck, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func init() {
+	activeImpl.Store(defaultImpl())
+	envErr = applyEnvironment()
+}
+
+var _ implInterface = (*implState)(nil)
@@ -0,0 +1,84 @@
+//
+// impl_amd64.go: Poly1305 amd64 backend selection.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+//go:build amd64 && gc && !purego
+
+package poly1305
+
+var (
+	implSSE2Impl = &implementation{name: "sse2", supported: true}
+	implAVX2Impl = &implementation{name: "avx2", supported: hasAVX2()}
+
+	archImplementations = []*implementation{
+		implSSE2Impl,
+		implAVX2Impl,
+	}
+)
+
+func archDefaultImpl() *implementation {
+	switch {
+	case implAVX2Impl.supported:
+		return implAVX2Impl
+	case implSSE2Impl.supported:
+		return implSSE2Impl
+	}
+	return nil
+}
+
+func (impl *implState) blocksWith(which *implementation, m []byte, bytes int, isFinal bool) {
+	switch which {
+	case implSSE2Impl:
+		(*implSSE2)(impl).blocks(m, bytes, isFinal)
+	case implAVX2Impl:
+		(*implAVX2)(impl).blocks(m, bytes, isFinal)
+	default:
+		impl.blocksGeneric(which, m, bytes, isFinal)
+	}
+}
+
+// blocksBatch processes the leading blocks that every message in msgs has
+// in common, with a message per lane of the freshly keyed lanes, and
+// returns the number of bytes of each message that it processed.
+func blocksBatch(lanes *[batchLanes]Poly1305, msgs [][]byte) int {
+	if activeImpl.Load() != implAVX2Impl || checkImpl.Load() != nil {
+		return 0
+	}
+	return blocksBatchAVX2(lanes, msgs)
+}
+
+//go:noescape
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+//go:noescape
+func xgetbv() (eax, edx uint32)
+
+func hasAVX2() bool {
+	const (
+		cpuidOSXSAVE = 1 << 27
+		cpuidAVX     = 1 << 28
+		cpuidAVX2    = 1 << 5
+
+		xcr0SSE = 1 << 1
+		xcr0AVX = 1 << 2
+	)
+
+	if maxID, _, _, _ := cpuid(0, 0); maxID < 7 {
+		return false
+	}
+
+	// The OS must also save the YMM registers on context switches.
+	if _, _, ecx, _ := cpuid(1, 0); ecx&(cpuidOSXSAVE|cpuidAVX) != cpuidOSXSAVE|cpuidAVX {
+		return false
+	}
+	if eax, _ := xgetbv(); eax&(xcr0SSE|xcr0AVX) != xcr0SSE|xcr0AVX {
+		return false
+	}
+
+	_, ebx, _, _ := cpuid(7, 0)
+	return ebx&cpuidAVX2 != 0
+}
@@ -0,0 +1,109 @@
+//
+// impl_amd64_test.go: Poly1305 amd64 backend tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+//go:build amd64 && gc && !purego
+
+package poly1305
+
+import (
+	"math/rand/v2"
+	"testing"
+)
+
+var vectorBackends = []struct {
+	impl     *implementation
+	minBytes int
+}{
+	{implSSE2Impl, sse2MinBytes},
+	{implAVX2Impl, avx2MinBytes},
+}
+
+// TestVectorDispatch drives the blocks of every vector backend directly,
+// with runs on either side of its threshold, against mul64.  Runs that are
+// too short to vectorize, and final blocks, never reach the kernels, so the
+// scalar fallback is covered on every host, and the kernels on the hosts
+// that support them.
+func TestVectorDispatch(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1305, 18))
+	m := make([]byte, 4*1024+3*BlockSize)
+	for i := range m {
+		m[i] = byte(rng.Uint32())
+	}
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(rng.Uint32())
+	}
+
+	for _, vec := range vectorBackends {
+		for _, n := range []int{
+			BlockSize,
+			vec.minBytes - BlockSize,
+			vec.minBytes,
+			vec.minBytes + BlockSize,
+			vec.minBytes + 3*BlockSize,
+			len(m) - 3*BlockSize,
+			len(m),
+		} {
+			for _, isFinal := range []bool{false, true} {
+				if n >= vec.minBytes && !isFinal && !vec.impl.supported {
+					continue
+				}
+
+				// Twice, so that the second run starts from the state
+				// left by the first.
+				var expected, impl implState
+				expected.initWith(implMul64Impl, key[:])
+				impl.initWith(vec.impl, key[:])
+				for i := 0; i < 2; i++ {
+					expected.blocksWith(implMul64Impl, m, n, isFinal)
+					impl.blocksWith(vec.impl, m, n, isFinal)
+				}
+
+				h, expectedH := impl.hElement(), expected.hElement()
+				if h.Equal(&expectedH) != 1 {
+					t.Errorf("%s: blocks(%d, %v) != mul64", vec.impl.name, n, isFinal)
+				}
+			}
+		}
+	}
+}
+
+func TestArchDefaultImplFallback(t *testing.T) {
+	defer func(impl *implementation, supported bool) {
+		activeImpl.Store(impl)
+		implAVX2Impl.supported = supported
+	}(activeImpl.Load(), implAVX2Impl.supported)
+
+	// Without AVX2, the default is SSE2, and AVX2 can not be picked.
+	implAVX2Impl.supported = false
+	if impl := defaultImpl(); impl != implSSE2Impl {
+		t.Errorf("defaultImpl() = %s, without AVX2", impl.name)
+	}
+	if err := ForceImplementation(implAVX2Impl.name); err != ErrUnsupportedImplementation {
+		t.Errorf("ForceImplementation(avx2): %v, without AVX2", err)
+	}
+	if err := EnableCrossCheck(implAVX2Impl.name); err != ErrUnsupportedImplementation {
+		t.Errorf("EnableCrossCheck(avx2): %v, without AVX2", err)
+	}
+	for _, name := range Implementations() {
+		if name == implAVX2Impl.name {
+			t.Errorf("Implementations(): includes avx2, without AVX2")
+		}
+	}
+
+	// The batch kernel is only used with the AVX2 backend.
+	activeImpl.Store(implSSE2Impl)
+	var lanes [batchLanes]Poly1305
+	msgs := make([][]byte, batchLanes)
+	for i := range msgs {
+		msgs[i] = make([]byte, 4*BlockSize)
+	}
+	if n := blocksBatch(&lanes, msgs); n != 0 {
+		t.Errorf("blocksBatch(): %d, with sse2", n)
+	}
+}
@@ -0,0 +1,25 @@
+//
+// impl_generic.go: Poly1305 generic backend selection.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+//go:build !amd64 || !gc || purego
+
+package poly1305
+
+var archImplementations []*implementation
+
+func archDefaultImpl() *implementation {
+	return nil
+}
+
+func (impl *implState) blocksWith(which *implementation, m []byte, bytes int, isFinal bool) {
+	impl.blocksGeneric(which, m, bytes, isFinal)
+}
+
+func blocksBatch(lanes *[batchLanes]Poly1305, msgs [][]byte) int {
+	return 0
+}
@@ -0,0 +1,253 @@
+//
+// impl_test.go: Poly1305 backend tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+// sumChunked is Sum, with m written in random sized chunks, half of which
+// are short enough to be buffered, and the rest long enough to reach the
+// vector kernels.
+func sumChunked(mac *[Size]byte, m []byte, key *[KeySize]byte, rng *rand.Rand) {
+	h, _ := New(key[:])
+	for len(m) > 0 {
+		n := 1 + rng.IntN(2*BlockSize)
+		if rng.IntN(2) == 0 {
+			n = 1 + rng.IntN(2048)
+		}
+		n = min(n, len(m))
+		h.Write(m[:n])
+		m = m[n:]
+	}
+	h.SumTo(mac)
+}
+
+func TestImplementationsDifferential(t *testing.T) {
+	disableReuseDetector(t)
+	defer func(impl *implementation) {
+		activeImpl.Store(impl)
+	}(activeImpl.Load())
+
+	rng := rand.New(rand.NewPCG(1305, 16))
+	m := make([]byte, 4*1024+100)
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			if !impl.supported {
+				t.Skipf("%s is not supported by the host", impl.name)
+			}
+
+			for i := 0; i <= len(m); i++ {
+				var key [KeySize]byte
+				for j := range key {
+					key[j] = byte(rng.Uint32())
+				}
+				msg := m[:i]
+				for j := range msg {
+					msg[j] = byte(rng.Uint32())
+				}
+
+				var expected, mac [Size]byte
+				activeImpl.Store(implDonna32Impl)
+				Sum(&expected, msg, &key)
+
+				activeImpl.Store(impl)
+				Sum(&mac, msg, &key)
+				if mac != expected {
+					t.Fatalf("[%d]: Sum() != donna32", i)
+				}
+				sumChunked(&mac, msg, &key, rng)
+				if mac != expected {
+					t.Fatalf("[%d]: chunked Sum() != donna32", i)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultImplFallback(t *testing.T) {
+	supported := make([]bool, len(archImplementations))
+	for i, impl := range archImplementations {
+		supported[i] = impl.supported
+		impl.supported = false
+	}
+	defer func() {
+		for i, impl := range archImplementations {
+			impl.supported = supported[i]
+		}
+	}()
+
+	switch impl := defaultImpl(); impl {
+	case implMul64Impl, implHornerImpl:
+	default:
+		t.Fatalf("defaultImpl() = %s, with no supported arch backends", impl.name)
+	}
+}
+
+func TestForceImplementation(t *testing.T) {
+	defer func(impl *implementation) {
+		activeImpl.Store(impl)
+	}(activeImpl.Load())
+
+	names := Implementations()
+	if len(names) == 0 {
+		t.Fatalf("Implementations(): no supported backends")
+	}
+	for _, name := range names {
+		if err := ForceImplementation(name); err != nil {
+			t.Fatalf("ForceImplementation(%s): %s", name, err)
+		}
+		if impl := Implementation(); impl != name {
+			t.Fatalf("ForceImplementation(%s): Implementation() = %s", name, impl)
+		}
+	}
+
+	if err := ForceImplementation("bogus"); err != ErrUnsupportedImplementation {
+		t.Errorf("ForceImplementation(bogus): %v", err)
+	}
+	if err := ForceImplementation(""); err != nil {
+		t.Fatalf("ForceImplementation(): %s", err)
+	}
+	if impl := Implementation(); impl != defaultImpl().name {
+		t.Errorf("ForceImplementation(): Implementation() = %s", impl)
+	}
+}
+
+func TestForceImplementationMidStream(t *testing.T) {
+	disableReuseDetector(t)
+	defer func(impl *implementation) {
+		activeImpl.Store(impl)
+	}(activeImpl.Load())
+
+	rng := rand.New(rand.NewPCG(1305, 15))
+	m := make([]byte, 1100)
+	for i := range m {
+		m[i] = byte(rng.Uint32())
+	}
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(rng.Uint32())
+	}
+	var expected [Size]byte
+	sumWith(implDonna32Impl, &expected, m, &key)
+
+	// The mul64 based backends keep h in their own form between calls,
+	// which must survive a change of backend.
+	names := Implementations()
+	for _, first := range names {
+		for _, second := range names {
+			activeImpl.Store(lookupImpl(first))
+			h, _ := New(key[:])
+			h.Write(m[:100])
+			h.Write(m[100:1000])
+
+			activeImpl.Store(lookupImpl(second))
+			h.Write(m[1000:])
+			var mac [Size]byte
+			h.SumTo(&mac)
+			if mac != expected {
+				t.Errorf("%s then %s: Sum() != donna32", first, second)
+			}
+		}
+	}
+}
+
+func TestApplyEnvironment(t *testing.T) {
+	defer func(impl, check *implementation) {
+		activeImpl.Store(impl)
+		checkImpl.Store(check)
+	}(activeImpl.Load(), checkImpl.Load())
+
+	// Invalid values are ignored, and reported.
+	activeImpl.Store(defaultImpl())
+	DisableCrossCheck()
+	t.Setenv(envImplementation, "bogus")
+	t.Setenv(envCrossCheck, "bogus")
+	if err := applyEnvironment(); !errors.Is(err, ErrUnsupportedImplementation) {
+		t.Errorf("applyEnvironment(bogus): %v", err)
+	}
+	if impl := Implementation(); impl != defaultImpl().name {
+		t.Errorf("applyEnvironment(bogus): Implementation() = %s", impl)
+	}
+	if check := checkImpl.Load(); check != nil {
+		t.Errorf("applyEnvironment(bogus): cross-checking against %s", check.name)
+	}
+
+	t.Setenv(envImplementation, implDonna32Impl.name)
+	t.Setenv(envCrossCheck, implMul64Impl.name)
+	if err := applyEnvironment(); err != nil {
+		t.Fatalf("applyEnvironment(): %s", err)
+	}
+	if impl := activeImpl.Load(); impl != implDonna32Impl {
+		t.Errorf("applyEnvironment(): Implementation() = %s", impl.name)
+	}
+	if check := checkImpl.Load(); check != implMul64Impl {
+		t.Errorf("applyEnvironment(): cross-checking against %v", check)
+	}
+}
+
+func TestCrossCheck(t *testing.T) {
+	disableReuseDetector(t)
+	defer func(impl *implementation) {
+		activeImpl.Store(impl)
+		DisableCrossCheck()
+	}(activeImpl.Load())
+
+	rng := rand.New(rand.NewPCG(1305, 19))
+	m := make([]byte, 4*1024+100)
+	for i := range m {
+		m[i] = byte(rng.Uint32())
+	}
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(rng.Uint32())
+	}
+
+	names := Implementations()
+	for _, active := range names {
+		for _, check := range names {
+			if err := ForceImplementation(active); err != nil {
+				t.Fatalf("ForceImplementation(%s): %s", active, err)
+			}
+			if err := EnableCrossCheck(check); err != nil {
+				t.Fatalf("EnableCrossCheck(%s): %s", check, err)
+			}
+
+			var mac [Size]byte
+			// Odd numbers of blocks leave a tail for the 2 and 4 way
+			// backends.
+			for _, n := range []int{0, 15, 16, 64, 255, 1024, 1040, 1100, 2047, 4096, len(m)} {
+				Sum(&mac, m[:n], &key)
+				sumChunked(&mac, m[:n], &key, rng)
+			}
+		}
+	}
+
+	if err := EnableCrossCheck("bogus"); err != ErrUnsupportedImplementation {
+		t.Errorf("EnableCrossCheck(bogus): %v", err)
+	}
+
+	// Break horner's cached r^4, which the cross-check must catch.
+	activeImpl.Store(implHornerImpl)
+	if err := EnableCrossCheck(implDonna32Impl.name); err != nil {
+		t.Fatalf("EnableCrossCheck(donna32): %s", err)
+	}
+	h, _ := New(key[:])
+	h.impl.rPow[2].One()
+	func() {
+		defer func() {
+			if err := recover(); err != ErrCrossCheckMismatch {
+				t.Errorf("h.Write(): with a broken backend, recover() = %v", err)
+			}
+		}()
+		h.Write(m[:1024])
+	}()
+}
@@ -0,0 +1,410 @@
+//
+// field.go: GF(2^130 - 5) arithmetic.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+// Package field implements constant time arithmetic over GF(2^130 - 5), the
+// field used by Poly1305, including the access to the 26-bit limbs that the
+// Poly1305 backends need.  The public API is github.com/Yawning/poly1305/field,
+// which wraps this package without the limb level methods.
+//
+// The implementation is the 26-bit limb arithmetic from Andrew Moon's
+// poly1305-donna-32.
+package field
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Size is the size of the canonical encoding of an Element in bytes.
+const Size = 17
+
+// ErrNonCanonical is the error returned when decoding a non-canonical
+// encoding of an Element.
+var ErrNonCanonical = errors.New("field: non-canonical encoding")
+
+// Element is an element of GF(2^130 - 5).  The zero value is 0.
+//
+// Elements are represented as five 26-bit limbs (radix 2^26), that are only
+// partially reduced between operations.  All operations are constant time
+// unless noted otherwise.
+type Element struct {
+	l [5]uint32
+}
+
+// Zero sets v to 0, and returns v.
+func (v *Element) Zero() *Element {
+	v.l = [5]uint32{}
+	return v
+}
+
+// One sets v to 1, and returns v.
+func (v *Element) One() *Element {
+	v.l = [5]uint32{1}
+	return v
+}
+
+// Set sets v to a, and returns v.
+func (v *Element) Set(a *Element) *Element {
+	*v = *a
+	return v
+}
+
+// SetLimbs sets v to l[0] + l[1]*2^26 + l[2]*2^52 + l[3]*2^78 + l[4]*2^104,
+// and returns v.  Each limb must be less than 2^31.
+func (v *Element) SetLimbs(l *[5]uint32) *Element {
+	v.l[0], v.l[1], v.l[2], v.l[3], v.l[4] = l[0], l[1], l[2], l[3], l[4]
+	v.carry()
+	return v
+}
+
+// Limbs returns the canonical 26-bit limbs of v, such that v is equal to
+// l[0] + l[1]*2^26 + l[2]*2^52 + l[3]*2^78 + l[4]*2^104, and every limb is
+// less than 2^26.
+func (v *Element) Limbs() (l [5]uint32) {
+	l[0], l[1], l[2], l[3], l[4] = v.reduced()
+	return
+}
+
+// SetBytes sets v to the canonical little endian encoding x, and returns v.
+// If x is not Size bytes, or is not canonical (ie: x >= 2^130 - 5), SetBytes
+// returns nil and ErrNonCanonical, and v is unchanged.
+func (v *Element) SetBytes(x []byte) (*Element, error) {
+	if len(x) != Size || x[Size-1] > 3 {
+		return nil, ErrNonCanonical
+	}
+
+	var t Element
+	t.l[0] = binary.LittleEndian.Uint32(x[0:]) & 0x3ffffff
+	t.l[1] = (binary.LittleEndian.Uint32(x[3:]) >> 2) & 0x3ffffff
+	t.l[2] = (binary.LittleEndian.Uint32(x[6:]) >> 4) & 0x3ffffff
+	t.l[3] = (binary.LittleEndian.Uint32(x[9:]) >> 6) & 0x3ffffff
+	t.l[4] = binary.LittleEndian.Uint32(x[13:]) & 0x3ffffff
+	if t.Limbs() != t.l {
+		return nil, ErrNonCanonical
+	}
+
+	*v = t
+	return v, nil
+}
+
+// Bytes returns the canonical little endian encoding of v.
+func (v *Element) Bytes() []byte {
+	// Outlined, so that the result does not escape when this is inlined.
+	var out [Size]byte
+	return v.bytes(&out)
+}
+
+func (v *Element) bytes(out *[Size]byte) []byte {
+	l0, l1, l2, l3, l4 := v.reduced()
+	binary.LittleEndian.PutUint32(out[0:], l0|l1<<26)
+	binary.LittleEndian.PutUint32(out[4:], l1>>6|l2<<20)
+	binary.LittleEndian.PutUint32(out[8:], l2>>12|l3<<14)
+	binary.LittleEndian.PutUint32(out[12:], l3>>18|l4<<8)
+	out[16] = byte(l4 >> 24)
+	return out[:]
+}
+
+// Equal returns 1 if v and u are equal, and 0 otherwise.
+func (v *Element) Equal(u *Element) int {
+	a, b := v.Limbs(), u.Limbs()
+	var d uint32
+	for i := range a {
+		d |= a[i] ^ b[i]
+	}
+	return int((d - 1) >> 31)
+}
+
+// Add sets v = a + b, and returns v.
+func (v *Element) Add(a, b *Element) *Element {
+	v.l[0] = a.l[0] + b.l[0]
+	v.l[1] = a.l[1] + b.l[1]
+	v.l[2] = a.l[2] + b.l[2]
+	v.l[3] = a.l[3] + b.l[3]
+	v.l[4] = a.l[4] + b.l[4]
+	v.carry()
+	return v
+}
+
+// Sub sets v = a - b, and returns v.
+func (v *Element) Sub(a, b *Element) *Element {
+	// a + 2p - b, as b is partially reduced, and every limb of 2p is
+	// larger than the corresponding limb of b.
+	v.l[0] = a.l[0] + 0x7fffff6 - b.l[0]
+	v.l[1] = a.l[1] + 0x7fffffe - b.l[1]
+	v.l[2] = a.l[2] + 0x7fffffe - b.l[2]
+	v.l[3] = a.l[3] + 0x7fffffe - b.l[3]
+	v.l[4] = a.l[4] + 0x7fffffe - b.l[4]
+	v.carry()
+	return v
+}
+
+// Negate sets v = -a, and returns v.
+func (v *Element) Negate(a *Element) *Element {
+	var zero Element
+	return v.Sub(&zero, a)
+}
+
+// Mul sets v = a * b, and returns v.
+func (v *Element) Mul(a, b *Element) *Element {
+	//
+	// poly1305-donna-32.h:poly1305_blocks()
+	//
+
+	var d0, d1, d2, d3, d4 uint64
+	var c uint64
+
+	h0, h1, h2, h3, h4 := uint64(a.l[0]), uint64(a.l[1]), uint64(a.l[2]), uint64(a.l[3]), uint64(a.l[4])
+	r0, r1, r2, r3, r4 := uint64(b.l[0]), uint64(b.l[1]), uint64(b.l[2]), uint64(b.l[3]), uint64(b.l[4])
+	s1, s2, s3, s4 := r1*5, r2*5, r3*5, r4*5
+
+	// h *= r
+	d0 = (h0 * r0) + (h1 * s4) + (h2 * s3) + (h3 * s2) + (h4 * s1)
+	d1 = (h0 * r1) + (h1 * r0) + (h2 * s4) + (h3 * s3) + (h4 * s2)
+	d2 = (h0 * r2) + (h1 * r1) + (h2 * r0) + (h3 * s4) + (h4 * s3)
+	d3 = (h0 * r3) + (h1 * r2) + (h2 * r1) + (h3 * r0) + (h4 * s4)
+	d4 = (h0 * r4) + (h1 * r3) + (h2 * r2) + (h3 * r1) + (h4 * r0)
+
+	// (partial) h %= p
+	c = d0 >> 26
+	h0 = d0 & 0x3ffffff
+
+	d1 += c
+	c = d1 >> 26
+	h1 = d1 & 0x3ffffff
+
+	d2 += c
+	c = d2 >> 26
+	h2 = d2 & 0x3ffffff
+
+	d3 += c
+	c = d3 >> 26
+	h3 = d3 & 0x3ffffff
+
+	d4 += c
+	c = d4 >> 26
+	h4 = d4 & 0x3ffffff
+
+	h0 += c * 5
+	c = h0 >> 26
+	h0 = h0 & 0x3ffffff
+
+	h1 += c
+
+	v.l[0], v.l[1], v.l[2], v.l[3], v.l[4] = uint32(h0), uint32(h1), uint32(h2), uint32(h3), uint32(h4)
+	return v
+}
+
+// Square sets v = a * a, and returns v.
+func (v *Element) Square(a *Element) *Element {
+	return v.Mul(a, a)
+}
+
+// Pow sets v = x^e, and returns v.  Pow is not constant time with respect
+// to e.
+func (v *Element) Pow(x *Element, e uint64) *Element {
+	var acc, sq Element
+	acc.One()
+	sq.Set(x)
+	for ; e > 0; e >>= 1 {
+		if e&1 == 1 {
+			acc.Mul(&acc, &sq)
+		}
+		sq.Square(&sq)
+	}
+	*v = acc
+	return v
+}
+
+// Invert sets v = 1/x, and returns v.  If x is 0, v is set to 0.
+func (v *Element) Invert(x *Element) *Element {
+	// x^(p-2), with p-2 = 2^130 - 7, which has every bit set except for
+	// bits 1 and 2.
+	var acc Element
+	acc.One()
+	for i := 129; i >= 0; i-- {
+		acc.Square(&acc)
+		if i != 1 && i != 2 {
+			acc.Mul(&acc, x)
+		}
+	}
+	*v = acc
+	return v
+}
+
+// Blocks sets v = (...((v + m_1) * r + m_2) * r + ... + m_n) * r, where m_i
+// is the i-th 16 byte block of m as a little endian integer, plus 2^128 if
+// hibit is set, and returns v.  Any trailing partial block of m is ignored.
+//
+// This is the Poly1305 accumulator update, and is considerably faster than
+// the equivalent sequence of Add and Mul calls.
+func (v *Element) Blocks(r *Element, m []byte, hibit bool) *Element {
+	//
+	// poly1305-donna-32.h:poly1305_blocks()
+	//
+
+	var hi uint32
+	var d0, d1, d2, d3, d4 uint64
+	var c uint64
+	if hibit {
+		hi = 1 << 24 // 1 << 128
+	}
+	r0, r1, r2, r3, r4 := uint64(r.l[0]), uint64(r.l[1]), uint64(r.l[2]), uint64(r.l[3]), uint64(r.l[4])
+	s1, s2, s3, s4 := r1*5, r2*5, r3*5, r4*5
+	h0, h1, h2, h3, h4 := uint64(v.l[0]), uint64(v.l[1]), uint64(v.l[2]), uint64(v.l[3]), uint64(v.l[4])
+
+	for len(m) >= 16 {
+		// h += m[i]
+		h0 += uint64(binary.LittleEndian.Uint32(m[0:]) & 0x3ffffff)
+		h1 += uint64((binary.LittleEndian.Uint32(m[3:]) >> 2) & 0x3ffffff)
+		h2 += uint64((binary.LittleEndian.Uint32(m[6:]) >> 4) & 0x3ffffff)
+		h3 += uint64((binary.LittleEndian.Uint32(m[9:]) >> 6) & 0x3ffffff)
+		h4 += uint64((binary.LittleEndian.Uint32(m[12:]) >> 8) | hi)
+
+		// h *= r
+		d0 = (h0 * r0) + (h1 * s4) + (h2 * s3) + (h3 * s2) + (h4 * s1)
+		d1 = (h0 * r1) + (h1 * r0) + (h2 * s4) + (h3 * s3) + (h4 * s2)
+		d2 = (h0 * r2) + (h1 * r1) + (h2 * r0) + (h3 * s4) + (h4 * s3)
+		d3 = (h0 * r3) + (h1 * r2) + (h2 * r1) + (h3 * r0) + (h4 * s4)
+		d4 = (h0 * r4) + (h1 * r3) + (h2 * r2) + (h3 * r1) + (h4 * r0)
+
+		// (partial) h %= p
+		c = d0 >> 26
+		h0 = d0 & 0x3ffffff
+
+		d1 += c
+		c = d1 >> 26
+		h1 = d1 & 0x3ffffff
+
+		d2 += c
+		c = d2 >> 26
+		h2 = d2 & 0x3ffffff
+
+		d3 += c
+		c = d3 >> 26
+		h3 = d3 & 0x3ffffff
+
+		d4 += c
+		c = d4 >> 26
+		h4 = d4 & 0x3ffffff
+
+		h0 += c * 5
+		c = h0 >> 26
+		h0 = h0 & 0x3ffffff
+
+		h1 += c
+
+		m = m[16:]
+	}
+
+	v.l[0], v.l[1], v.l[2], v.l[3], v.l[4] = uint32(h0), uint32(h1), uint32(h2), uint32(h3), uint32(h4)
+	return v
+}
+
+// carry partially reduces v, with limbs of at most 31 bits.
+func (v *Element) carry() {
+	var c uint32
+
+	h0, h1, h2, h3, h4 := v.l[0], v.l[1], v.l[2], v.l[3], v.l[4]
+
+	c = h0 >> 26
+	h0 &= 0x3ffffff
+
+	h1 += c
+	c = h1 >> 26
+	h1 &= 0x3ffffff
+
+	h2 += c
+	c = h2 >> 26
+	h2 &= 0x3ffffff
+
+	h3 += c
+	c = h3 >> 26
+	h3 &= 0x3ffffff
+
+	h4 += c
+	c = h4 >> 26
+	h4 &= 0x3ffffff
+
+	h0 += c * 5
+	c = h0 >> 26
+	h0 &= 0x3ffffff
+
+	h1 += c
+
+	v.l[0], v.l[1], v.l[2], v.l[3], v.l[4] = h0, h1, h2, h3, h4
+}
+
+// reduced returns the limbs of v fully reduced, with v's limbs as returned by
+// carry.
+func (v *Element) reduced() (uint32, uint32, uint32, uint32, uint32) {
+	//
+	// poly1305-donna-32.h:poly1305_finish()
+	//
+
+	var c uint32
+	var g0, g1, g2, g3, g4 uint32
+	var mask uint32
+
+	// fully carry h
+	h0, h1, h2, h3, h4 := v.l[0], v.l[1], v.l[2], v.l[3], v.l[4]
+	c = h1 >> 26
+	h1 &= 0x3ffffff
+
+	h2 += c
+	c = h2 >> 26
+	h2 &= 0x3ffffff
+
+	h3 += c
+	c = h3 >> 26
+	h3 &= 0x3ffffff
+
+	h4 += c
+	c = h4 >> 26
+	h4 &= 0x3ffffff
+
+	h0 += c * 5
+	c = h0 >> 26
+	h0 &= 0x3ffffff
+
+	h1 += c
+
+	// compute h + -p
+	g0 = h0 + 5
+	c = g0 >> 26
+	g0 &= 0x3ffffff
+
+	g1 = h1 + c
+	c = g1 >> 26
+	g1 &= 0x3ffffff
+
+	g2 = h2 + c
+	c = g2 >> 26
+	g2 &= 0x3ffffff
+
+	g3 = h3 + c
+	c = g3 >> 26
+	g3 &= 0x3ffffff
+
+	g4 = h4 + c - (1 << 26)
+
+	// select h if h < p, or h + -p if h >= p
+	mask = (g4 >> ((4 * 8) - 1)) - 1
+	g0 &= mask
+	g1 &= mask
+	g2 &= mask
+	g3 &= mask
+	g4 &= mask
+	mask = ^mask
+	h0 = (h0 & mask) | g0
+	h1 = (h1 & mask) | g1
+	h2 = (h2 & mask) | g2
+	h3 = (h3 & mask) | g3
+	h4 = (h4 & mask) | g4
+
+	return h0, h1, h2, h3, h4
+}
@@ -0,0 +1,220 @@
+//
+// field_test.go: GF(2^130 - 5) arithmetic and limb level tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package field
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand/v2"
+	"testing"
+)
+
+var bigP = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 130), big.NewInt(5))
+
+func toBig(v *Element) *big.Int {
+	b := v.Bytes()
+	le := make([]byte, len(b))
+	for i := range b {
+		le[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(le)
+}
+
+func fromBig(t *testing.T, x *big.Int) *Element {
+	x = new(big.Int).Mod(x, bigP)
+	b := make([]byte, Size)
+	x.FillBytes(b)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	v, err := new(Element).SetBytes(b)
+	if err != nil {
+		t.Fatalf("SetBytes(%x): %s", b, err)
+	}
+	return v
+}
+
+func testValues(t *testing.T, rng *rand.Rand) []*big.Int {
+	vals := []*big.Int{
+		big.NewInt(0),
+		big.NewInt(1),
+		big.NewInt(5),
+		new(big.Int).Sub(bigP, big.NewInt(1)),
+		new(big.Int).Lsh(big.NewInt(1), 128),
+		new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(1)),
+		new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 26), big.NewInt(1)),
+	}
+	for i := 0; i < 64; i++ {
+		var b [Size]byte
+		for j := range b {
+			b[j] = byte(rng.Uint32())
+		}
+		vals = append(vals, new(big.Int).Mod(new(big.Int).SetBytes(b[:]), bigP))
+	}
+	return vals
+}
+
+func requireEqual(t *testing.T, op string, v *Element, expected *big.Int) {
+	t.Helper()
+	expected = new(big.Int).Mod(expected, bigP)
+	if got := toBig(v); got.Cmp(expected) != 0 {
+		t.Fatalf("%s: %x (expected: %x)", op, got, expected)
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1305, 14))
+	vals := testValues(t, rng)
+
+	for _, a := range vals {
+		x := fromBig(t, a)
+		requireEqual(t, "SetBytes/Bytes", x, a)
+		requireEqual(t, "Square", new(Element).Square(x), new(big.Int).Mul(a, a))
+		requireEqual(t, "Negate", new(Element).Negate(x), new(big.Int).Neg(a))
+
+		e := rng.Uint64()
+		requireEqual(t, "Pow", new(Element).Pow(x, e), new(big.Int).Exp(a, new(big.Int).SetUint64(e), bigP))
+
+		inv := new(Element).Invert(x)
+		if a.Sign() == 0 {
+			requireEqual(t, "Invert(0)", inv, a)
+		} else {
+			requireEqual(t, "Invert", inv, new(big.Int).ModInverse(a, bigP))
+		}
+
+		for _, b := range vals {
+			y := fromBig(t, b)
+			requireEqual(t, "Add", new(Element).Add(x, y), new(big.Int).Add(a, b))
+			requireEqual(t, "Sub", new(Element).Sub(x, y), new(big.Int).Sub(a, b))
+			requireEqual(t, "Mul", new(Element).Mul(x, y), new(big.Int).Mul(a, b))
+
+			if eq := x.Equal(y); (eq == 1) != (a.Cmp(b) == 0) {
+				t.Fatalf("Equal(%x, %x): %d", a, b, eq)
+			}
+		}
+	}
+}
+
+func TestChainedArithmetic(t *testing.T) {
+	// Long chains of operations must never exceed the limb bounds.
+	rng := rand.New(rand.NewPCG(1305, 140))
+	vals := testValues(t, rng)
+
+	acc, expected := new(Element), new(big.Int)
+	for i := 0; i < 10000; i++ {
+		b := vals[rng.IntN(len(vals))]
+		y := fromBig(t, b)
+		switch rng.IntN(4) {
+		case 0:
+			acc.Add(acc, y)
+			expected.Add(expected, b)
+		case 1:
+			acc.Sub(acc, y)
+			expected.Sub(expected, b)
+		case 2:
+			acc.Mul(acc, y)
+			expected.Mul(expected, b)
+		case 3:
+			acc.Add(acc, acc)
+			expected.Add(expected, expected)
+		}
+		expected.Mod(expected, bigP)
+		requireEqual(t, "chain", acc, expected)
+	}
+}
+
+func TestSetBytesNonCanonical(t *testing.T) {
+	for _, x := range []*big.Int{
+		bigP,
+		new(big.Int).Add(bigP, big.NewInt(4)),
+		new(big.Int).Lsh(big.NewInt(1), 131),
+	} {
+		b := make([]byte, Size+1)
+		x.FillBytes(b)
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		v := new(Element).One()
+		if _, err := v.SetBytes(b[:Size]); err != ErrNonCanonical {
+			t.Errorf("SetBytes(%x): %v (expected: ErrNonCanonical)", x, err)
+		}
+		if v.Equal(new(Element).One()) != 1 {
+			t.Errorf("SetBytes(%x) modified v on failure", x)
+		}
+	}
+	if _, err := new(Element).SetBytes(make([]byte, Size-1)); err != ErrNonCanonical {
+		t.Errorf("SetBytes(short): %v (expected: ErrNonCanonical)", err)
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1305, 142))
+	vals := testValues(t, rng)
+
+	for i, a := range vals {
+		r := fromBig(t, vals[(i+1)%len(vals)])
+		b := vals[(i+1)%len(vals)]
+		m := make([]byte, 16*(i%5)+i%16)
+		for j := range m {
+			m[j] = byte(rng.Uint32())
+		}
+		if i == 0 {
+			for j := range m {
+				m[j] = 0xff
+			}
+		}
+
+		for _, hibit := range []bool{false, true} {
+			expected := new(big.Int).Set(a)
+			for off := 0; off+16 <= len(m); off += 16 {
+				var le [16]byte
+				for j := range le {
+					le[j] = m[off+15-j]
+				}
+				blk := new(big.Int).SetBytes(le[:])
+				if hibit {
+					blk.SetBit(blk, 128, 1)
+				}
+				expected.Add(expected, blk)
+				expected.Mul(expected, b)
+				expected.Mod(expected, bigP)
+			}
+			requireEqual(t, "Blocks", new(Element).Set(fromBig(t, a)).Blocks(r, m, hibit), expected)
+		}
+	}
+}
+
+func TestLimbs(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1305, 141))
+	for i := 0; i < 1000; i++ {
+		var l [5]uint32
+		expected := new(big.Int)
+		for j := 4; j >= 0; j-- {
+			l[j] = rng.Uint32() >> 1
+			if i == 0 {
+				l[j] = 1<<31 - 1
+			}
+			expected.Lsh(expected, 26)
+			expected.Add(expected, big.NewInt(int64(l[j])))
+		}
+		v := new(Element).SetLimbs(&l)
+		requireEqual(t, "SetLimbs", v, expected)
+
+		canon := v.Limbs()
+		v2 := new(Element).SetLimbs(&canon)
+		for j, limb := range canon {
+			if limb >= 1<<26 {
+				t.Fatalf("Limbs()[%d] not canonical: %x", j, limb)
+			}
+		}
+		if v2.Equal(v) != 1 || !bytes.Equal(v2.Bytes(), v.Bytes()) {
+			t.Fatalf("SetLimbs(Limbs()) != v")
+		}
+	}
+}
@@ -0,0 +1,56 @@
+//
+// locked.go: Poly1305 instances in locked memory.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import "errors"
+
+var (
+	// ErrMemoryNotLocked is the error returned (wrapped) along with a usable
+	// instance when NewLocked fails to lock the instance's memory.
+	ErrMemoryNotLocked = errors.New("poly1305: failed to lock memory")
+
+	// ErrLockedUnsupported is the error returned when NewLocked is not
+	// supported on the current platform, or when built with the purego
+	// build tag.
+	ErrLockedUnsupported = errors.New("poly1305: locked memory not supported")
+)
+
+// NewLocked returns a new Poly1305 instance keyed with the supplied key, that
+// lives outside of the Go heap in memory that is locked (never swapped out),
+// excluded from core dumps, and surrounded by guard pages.
+//
+// If the memory could not be locked (eg: RLIMIT_MEMLOCK is too small), an
+// instance with every other protection is returned along with an error
+// wrapping ErrMemoryNotLocked, and it is up to the caller to decide if that
+// is acceptable.  Instances must be released with Destroy.  Note that copies
+// made via Clone are regular heap allocations.
+func NewLocked(key []byte) (*Poly1305, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKeySize
+	}
+	if err := checkSelfTest(); err != nil {
+		return nil, err
+	}
+
+	st, err := newLocked()
+	if st == nil {
+		return nil, err
+	}
+	checkKeyReuse(reuseRoleTag, key)
+	st.rekey(key)
+	return st, err
+}
+
+// Destroy purges the sensitive material in hash's internal state, and for
+// instances created with NewLocked, releases the backing memory.  The
+// instance must not be used after Destroy returns.
+func (st *Poly1305) Destroy() error {
+	st.Clear()
+	return destroyLocked(st)
+}
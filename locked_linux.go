@@ -0,0 +1,92 @@
+//
+// locked_linux.go: Poly1305 instances in locked memory (Linux).
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+//go:build !purego
+
+package poly1305
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// madvDontDump is MADV_DONTDUMP, which is missing from syscall on some
+// architectures.
+const madvDontDump = 0x10
+
+var (
+	lockedLock    sync.Mutex
+	lockedRegions = make(map[*Poly1305]lockedRegion)
+)
+
+type lockedRegion struct {
+	mapping []byte
+	data    []byte
+}
+
+func newLocked() (*Poly1305, error) {
+	// [guard page][data pages][guard page], with the instance placed at the
+	// end of the data pages, so that linear overflows fault.
+	pageSize := os.Getpagesize()
+	stSize := int(unsafe.Sizeof(Poly1305{}))
+	dataSize := (stSize + pageSize - 1) &^ (pageSize - 1)
+
+	mapping, err := syscall.Mmap(-1, 0, dataSize+2*pageSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, fmt.Errorf("poly1305: mmap: %w", err)
+	}
+	r := lockedRegion{
+		mapping: mapping,
+		data:    mapping[pageSize : pageSize+dataSize],
+	}
+	for _, guard := range [][]byte{mapping[:pageSize], mapping[pageSize+dataSize:]} {
+		if err = syscall.Mprotect(guard, syscall.PROT_NONE); err != nil {
+			syscall.Munmap(mapping)
+			return nil, fmt.Errorf("poly1305: mprotect: %w", err)
+		}
+	}
+	if err = syscall.Madvise(r.data, madvDontDump); err != nil {
+		syscall.Munmap(mapping)
+		return nil, fmt.Errorf("poly1305: madvise: %w", err)
+	}
+	var lockErr error
+	if err = syscall.Mlock(r.data); err != nil {
+		lockErr = fmt.Errorf("%w: %v", ErrMemoryNotLocked, err)
+	}
+
+	// This is only sound as long as Poly1305 is pointer free.
+	align := int(unsafe.Alignof(Poly1305{}))
+	off := (dataSize - stSize) &^ (align - 1)
+	st := (*Poly1305)(unsafe.Pointer(&r.data[off]))
+
+	lockedLock.Lock()
+	defer lockedLock.Unlock()
+	lockedRegions[st] = r
+
+	return st, lockErr
+}
+
+func destroyLocked(st *Poly1305) error {
+	lockedLock.Lock()
+	defer lockedLock.Unlock()
+
+	r, ok := lockedRegions[st]
+	if !ok {
+		return nil
+	}
+	delete(lockedRegions, st)
+
+	// Unmapping the region also unlocks it.
+	if err := syscall.Munmap(r.mapping); err != nil {
+		return fmt.Errorf("poly1305: munmap: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+//
+// locked_linux_test.go: Poly1305 locked memory tests (Linux).
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+//go:build !purego
+
+package poly1305
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// smapsFlags returns the permissions and VmFlags of the mapping containing
+// addr, and of the mappings immediately before and after it.
+func smapsFlags(t *testing.T, addr uintptr) (perms [3]string, flags string) {
+	f, err := os.Open("/proc/self/smaps")
+	if err != nil {
+		t.Skipf("failed to open smaps: %s", err)
+	}
+	defer f.Close()
+
+	var prevPerms string
+	var prevEnd uintptr
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "VmFlags:") {
+			if found && flags == "" {
+				flags = line
+			}
+			continue
+		}
+		var start, end uintptr
+		var p string
+		if n, _ := fmt.Sscanf(line, "%x-%x %s", &start, &end, &p); n != 3 {
+			continue
+		}
+		switch {
+		case found:
+			if start == prevEnd {
+				perms[2] = p
+			}
+			return
+		case addr >= start && addr < end:
+			found = true
+			if start == prevEnd {
+				perms[0] = prevPerms
+			}
+			perms[1] = p
+		}
+		prevPerms, prevEnd = p, end
+	}
+	if !found {
+		t.Fatalf("mapping for %#x not found", addr)
+	}
+	return
+}
+
+func TestNewLocked(t *testing.T) {
+	disableReuseDetector(t)
+
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(0x55 ^ i)
+	}
+	m := []byte("the key never hits swap or a core dump")
+
+	h, err := NewLocked(key[:])
+	if err != nil && !errors.Is(err, ErrMemoryNotLocked) {
+		t.Fatalf("NewLocked(): %s", err)
+	}
+	locked := err == nil
+
+	perms, flags := smapsFlags(t, uintptr(unsafe.Pointer(h)))
+	if !strings.HasPrefix(perms[0], "---") || !strings.HasPrefix(perms[2], "---") {
+		t.Errorf("missing guard pages: %v", perms)
+	}
+	if !strings.HasPrefix(perms[1], "rw") {
+		t.Errorf("unexpected permissions: %v", perms[1])
+	}
+	if !strings.Contains(flags, " dd") {
+		t.Errorf("mapping not excluded from core dumps: %s", flags)
+	}
+	if locked && !strings.Contains(flags, " lo") {
+		t.Errorf("mapping not locked: %s", flags)
+	}
+
+	h.Write(m)
+	var expected [Size]byte
+	Sum(&expected, m, &key)
+	if mac := h.Sum(nil); !bytes.Equal(mac, expected[:]) {
+		t.Errorf("mac != Sum(m)")
+	}
+
+	if err = h.Destroy(); err != nil {
+		t.Fatalf("h.Destroy(): %s", err)
+	}
+	if _, ok := lockedRegions[h]; ok {
+		t.Fatalf("h.Destroy() did not release the region")
+	}
+
+	if _, err = NewLocked(key[:1]); err != ErrInvalidKeySize {
+		t.Errorf("NewLocked(short key): %v", err)
+	}
+
+	// Heap instances can be destroyed as well.
+	h, _ = New(key[:])
+	if err = h.Destroy(); err != nil {
+		t.Errorf("h.Destroy() (heap): %s", err)
+	}
+	requireWiped(t, "Destroy", h)
+}
+
+func TestNewLockedRlimit(t *testing.T) {
+	disableReuseDetector(t)
+
+	rlimitMemlock := 8
+	if strings.HasPrefix(runtime.GOARCH, "mips") {
+		rlimitMemlock = 9
+	}
+
+	var old syscall.Rlimit
+	if err := syscall.Getrlimit(rlimitMemlock, &old); err != nil {
+		t.Skipf("getrlimit: %s", err)
+	}
+	lowered := old
+	lowered.Cur = 0
+	if err := syscall.Setrlimit(rlimitMemlock, &lowered); err != nil {
+		t.Skipf("setrlimit: %s", err)
+	}
+	defer syscall.Setrlimit(rlimitMemlock, &old)
+
+	var key [KeySize]byte
+	h, err := NewLocked(key[:])
+	switch {
+	case err == nil:
+		// CAP_IPC_LOCK ignores RLIMIT_MEMLOCK.
+		t.Log("mlock succeeded despite RLIMIT_MEMLOCK = 0")
+	case !errors.Is(err, ErrMemoryNotLocked):
+		t.Fatalf("NewLocked(): %s", err)
+	case h == nil:
+		t.Fatalf("NewLocked() did not fall back")
+	}
+
+	// The fallback instance is fully functional.
+	var expected [Size]byte
+	Sum(&expected, nil, &key)
+	if mac := h.Sum(nil); !bytes.Equal(mac, expected[:]) {
+		t.Errorf("mac != Sum(nil)")
+	}
+	if err = h.Destroy(); err != nil {
+		t.Fatalf("h.Destroy(): %s", err)
+	}
+}
+
+// hasPointers returns the path to the first pointer bearing field of typ,
+// if any.
+func hasPointers(typ reflect.Type, path string) (string, bool) {
+	switch typ.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return "", false
+	case reflect.Array:
+		return hasPointers(typ.Elem(), path+"[]")
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if p, ok := hasPointers(f.Type, path+"."+f.Name); ok {
+				return p, true
+			}
+		}
+		return "", false
+	}
+	return path + " (" + typ.Kind().String() + ")", true
+}
+
+func TestPoly1305PointerFree(t *testing.T) {
+	if path, ok := hasPointers(reflect.TypeOf(Poly1305{}), "Poly1305"); ok {
+		t.Fatalf("%s holds a pointer, which NewLocked's memory hides from the GC", path)
+	}
+}
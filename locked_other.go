@@ -0,0 +1,19 @@
+//
+// locked_other.go: Poly1305 instances in locked memory (unsupported).
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+//go:build !linux || purego
+
+package poly1305
+
+func newLocked() (*Poly1305, error) {
+	return nil, ErrLockedUnsupported
+}
+
+func destroyLocked(st *Poly1305) error {
+	return nil
+}
@@ -0,0 +1,262 @@
+//
+// marshal.go: Poly1305 state serialization.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// SealKeySize is the key size in bytes used by MarshalSealed and
+	// UnmarshalSealed.
+	SealKeySize = 32
+
+	stateMagic   = "poly1305"
+	stateVersion = 1
+
+	// stateImplLimbs26 is the implementation tag for states where r and h
+	// are serialized as five 26-bit limbs, with h fully reduced mod p.
+	stateImplLimbs26 = 1
+
+	stateHeaderSize = len(stateMagic) + 2
+	stateSize       = stateHeaderSize + (5+5+4)*4 + 2 + BlockSize
+
+	sealedMagic = "poly1305-sealed"
+	sealedSize  = 12 + stateSize + 16
+)
+
+var (
+	// ErrInvalidState is the error returned when a serialized state does not
+	// have the expected magic.
+	ErrInvalidState = errors.New("poly1305: invalid serialized state")
+
+	// ErrStateTruncated is the error returned when a serialized state has
+	// an invalid length.
+	ErrStateTruncated = errors.New("poly1305: truncated serialized state")
+
+	// ErrStateVersion is the error returned when a serialized state has an
+	// unsupported version or implementation tag.
+	ErrStateVersion = errors.New("poly1305: unsupported serialized state version")
+
+	// ErrStateNonCanonical is the error returned when a serialized state
+	// contains non-canonical limbs or buffer contents.
+	ErrStateNonCanonical = errors.New("poly1305: non-canonical serialized state")
+
+	// ErrStateAuthentication is the error returned when a sealed serialized
+	// state fails to authenticate.
+	ErrStateAuthentication = errors.New("poly1305: sealed state authentication failed")
+
+	rClampMask = [5]uint32{0x3ffffff, 0x3ffff03, 0x3ffc0ff, 0x3f03fff, 0x00fffff}
+)
+
+// AppendBinary appends the serialized hash state to b and returns the
+// resulting slice.  The serialized state includes the one-time key and the
+// tag size, and must be handled as carefully as the key itself, see
+// MarshalSealed.
+func (st *Poly1305) AppendBinary(b []byte) ([]byte, error) {
+	if err := st.statusErr(); err != nil {
+		return b, err
+	}
+
+	b = append(b, stateMagic...)
+	b = append(b, stateVersion, stateImplLimbs26)
+	for _, v := range st.impl.r.Limbs() {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+	h := st.impl.hElement()
+	for _, v := range h.Limbs() {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+	for _, v := range st.impl.pad {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+	b = append(b, byte(st.Size()))
+	b = append(b, byte(st.leftover))
+	b = append(b, st.buffer[:st.leftover]...)
+	b = append(b, make([]byte, BlockSize-st.leftover)...)
+	return b, nil
+}
+
+// MarshalBinary returns the serialized hash state.  See AppendBinary.
+func (st *Poly1305) MarshalBinary() ([]byte, error) {
+	return st.AppendBinary(make([]byte, 0, stateSize))
+}
+
+// UnmarshalBinary restores the hash state from a serialized state produced
+// by MarshalBinary.  Restoring a state keys the instance, so it runs the
+// same self-test (see EnableSelfTestOnFirstUse) and key reuse checks (see
+// EnableReuseDetector) as New.  It returns ErrInvalidMacSize if the tag size
+// is not one of those accepted by SetTagSize.  The hash state is left
+// untouched on failure.
+func (st *Poly1305) UnmarshalBinary(b []byte) error {
+	var tmp Poly1305
+	defer tmp.Clear()
+	if err := tmp.unmarshalBinary(b); err != nil {
+		return err
+	}
+	if err := checkSelfTest(); err != nil {
+		return err
+	}
+	checkStateKeyReuse(&tmp.impl)
+
+	tmp.resettable = st.resettable
+	*st = tmp
+	return nil
+}
+
+// unmarshalBinary restores the hash state from a serialized state, without
+// the entry checks, and leaves the hash state untouched on failure.
+func (st *Poly1305) unmarshalBinary(b []byte) error {
+	if len(b) < stateHeaderSize {
+		return ErrStateTruncated
+	}
+	if string(b[:len(stateMagic)]) != stateMagic {
+		return ErrInvalidState
+	}
+	b = b[len(stateMagic):]
+	if b[0] != stateVersion || b[1] != stateImplLimbs26 {
+		return ErrStateVersion
+	}
+	if len(b) != stateSize-len(stateMagic) {
+		return ErrStateTruncated
+	}
+	b = b[2:]
+
+	var impl implState
+	var r, h [5]uint32
+	for i := range r {
+		r[i] = binary.LittleEndian.Uint32(b[i*4:])
+		if r[i]&rClampMask[i] != r[i] {
+			return ErrStateNonCanonical
+		}
+	}
+	b = b[len(r)*4:]
+	for i := range h {
+		h[i] = binary.LittleEndian.Uint32(b[i*4:])
+		if h[i] > 0x3ffffff {
+			return ErrStateNonCanonical
+		}
+	}
+	b = b[len(h)*4:]
+	impl.r.SetLimbs(&r)
+	if impl.h.SetLimbs(&h).Limbs() != h {
+		return ErrStateNonCanonical
+	}
+	for i := range impl.pad {
+		impl.pad[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	b = b[len(impl.pad)*4:]
+
+	tagSize := int(b[0])
+	if !validTagSize(tagSize) {
+		return ErrInvalidMacSize
+	}
+	leftover := int(b[1])
+	b = b[2:]
+	if leftover >= BlockSize {
+		return ErrStateNonCanonical
+	}
+	for _, v := range b[leftover:] {
+		if v != 0 {
+			return ErrStateNonCanonical
+		}
+	}
+
+	st.impl = impl
+	st.tagSize = tagSize
+	st.leftover = leftover
+	copy(st.buffer[:], b)
+	st.status = statusKeyed
+	return nil
+}
+
+// checkStateKeyReuse passes the key of a restored state to the key reuse
+// detector.  Only the clamped r is serialized, see reuseDetector.check.
+func checkStateKeyReuse(impl *implState) {
+	var key [KeySize]byte
+	defer burnBytes(key[:])
+
+	r := impl.r.Bytes()
+	copy(key[:16], r)
+	burnBytes(r)
+	for i, v := range impl.pad {
+		binary.LittleEndian.PutUint32(key[16+i*4:], v)
+	}
+	checkKeyReuse(reuseRoleTag, key[:])
+}
+
+// MarshalSealed returns the serialized hash state, encrypted and
+// authenticated with AES-256-GCM under key, which must be SealKeySize bytes.
+func (st *Poly1305) MarshalSealed(key []byte) ([]byte, error) {
+	aead, err := newSealAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext [stateSize]byte
+	defer burnBytes(plaintext[:])
+	if _, err = st.AppendBinary(plaintext[:0]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, aead.NonceSize(), sealedSize)
+	if _, err = rand.Read(b); err != nil {
+		return nil, err
+	}
+	return aead.Seal(b, b, plaintext[:], []byte(sealedMagic)), nil
+}
+
+// UnmarshalSealed restores the hash state from a serialized state produced
+// by MarshalSealed under the same key.  The hash state is left untouched on
+// failure.
+func (st *Poly1305) UnmarshalSealed(key, b []byte) error {
+	aead, err := newSealAEAD(key)
+	if err != nil {
+		return err
+	}
+	if len(b) != sealedSize {
+		return ErrStateTruncated
+	}
+
+	var plaintext [stateSize]byte
+	defer burnBytes(plaintext[:])
+	nonce, ciphertext := b[:aead.NonceSize()], b[aead.NonceSize():]
+	if _, err = aead.Open(plaintext[:0], nonce, ciphertext, []byte(sealedMagic)); err != nil {
+		return ErrStateAuthentication
+	}
+	return st.UnmarshalBinary(plaintext[:])
+}
+
+func newSealAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != SealKeySize {
+		return nil, ErrInvalidKeySize
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func burnBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+var (
+	_ encoding.BinaryAppender    = (*Poly1305)(nil)
+	_ encoding.BinaryMarshaler   = (*Poly1305)(nil)
+	_ encoding.BinaryUnmarshaler = (*Poly1305)(nil)
+)
@@ -0,0 +1,173 @@
+//
+// marshal_test.go: Poly1305 state serialization tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func newTestInstance(t *testing.T) (*Poly1305, *[KeySize]byte, []byte) {
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(0x80 + i)
+	}
+	m := make([]byte, 300)
+	for i := range m {
+		m[i] = byte(i * 7)
+	}
+
+	h, err := New(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, &key, m
+}
+
+func TestMarshalBinary(t *testing.T) {
+	disableReuseDetector(t)
+
+	_, key, m := newTestInstance(t)
+	var expected [Size]byte
+	Sum(&expected, m, key)
+
+	for _, split := range []int{0, 1, 15, 16, 17, 64, 129, 299, 300} {
+		h, _ := New(key[:])
+		h.Write(m[:split])
+		if split == 129 {
+			h.SetTagSize(12)
+		}
+
+		b, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatalf("[%d]: h.MarshalBinary(): %s", split, err)
+		} else if len(b) != stateSize {
+			t.Fatalf("[%d]: h.MarshalBinary(): %d bytes (expected: %d)", split, len(b), stateSize)
+		}
+
+		var h2 Poly1305
+		if err = h2.UnmarshalBinary(b); err != nil {
+			t.Fatalf("[%d]: h2.UnmarshalBinary(): %s", split, err)
+		}
+		if h2.Size() != h.Size() {
+			t.Errorf("[%d]: restored Size() = %d (expected: %d)", split, h2.Size(), h.Size())
+		}
+		h2.Write(m[split:])
+		if mac := h2.Sum(nil); !bytes.Equal(mac, expected[:h.Size()]) {
+			t.Errorf("[%d]: restored mac != expected", split)
+		}
+
+		prefix := []byte("prefix")
+		b2, err := h.AppendBinary(prefix)
+		if err != nil {
+			t.Fatalf("[%d]: h.AppendBinary(): %s", split, err)
+		} else if !bytes.Equal(b2[:len(prefix)], prefix) || !bytes.Equal(b2[len(prefix):], b) {
+			t.Errorf("[%d]: h.AppendBinary() != prefix || h.MarshalBinary()", split)
+		}
+	}
+}
+
+func TestUnmarshalBinaryErrors(t *testing.T) {
+	h, _, m := newTestInstance(t)
+	h.Write(m[:21])
+	good, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hOff := stateHeaderSize + 5*4
+	leftoverOff := stateSize - BlockSize - 1
+	for i, vec := range []struct {
+		mutate func(b []byte) []byte
+		err    error
+	}{
+		{func(b []byte) []byte { return b[:stateHeaderSize-1] }, ErrStateTruncated},
+		{func(b []byte) []byte { return b[:len(b)-1] }, ErrStateTruncated},
+		{func(b []byte) []byte { return append(b, 0) }, ErrStateTruncated},
+		{func(b []byte) []byte { b[0] ^= 1; return b }, ErrInvalidState},
+		{func(b []byte) []byte { b[len(stateMagic)] = stateVersion + 1; return b }, ErrStateVersion},
+		{func(b []byte) []byte { b[len(stateMagic)+1] = 0; return b }, ErrStateVersion},
+		{func(b []byte) []byte {
+			// r with clamped bits set.
+			b[stateHeaderSize+4] |= 0x04
+			return b
+		}, ErrStateNonCanonical},
+		{func(b []byte) []byte {
+			// h limb >= 2^26.
+			binary.LittleEndian.PutUint32(b[hOff:], 1<<26)
+			return b
+		}, ErrStateNonCanonical},
+		{func(b []byte) []byte {
+			// h == p.
+			for i, v := range []uint32{0x3fffffb, 0x3ffffff, 0x3ffffff, 0x3ffffff, 0x3ffffff} {
+				binary.LittleEndian.PutUint32(b[hOff+i*4:], v)
+			}
+			return b
+		}, ErrStateNonCanonical},
+		{func(b []byte) []byte { b[leftoverOff-1] = 0; return b }, ErrInvalidMacSize},
+		{func(b []byte) []byte { b[leftoverOff-1] = Size + 1; return b }, ErrInvalidMacSize},
+		{func(b []byte) []byte { b[leftoverOff] = BlockSize; return b }, ErrStateNonCanonical},
+		{func(b []byte) []byte { b[len(b)-1] = 1; return b }, ErrStateNonCanonical},
+	} {
+		var h2 Poly1305
+		b := vec.mutate(append([]byte{}, good...))
+		if err := h2.UnmarshalBinary(b); err != vec.err {
+			t.Errorf("[%d]: h2.UnmarshalBinary(): %v (expected: %v)", i, err, vec.err)
+		}
+		if h2 != (Poly1305{}) {
+			t.Errorf("[%d]: h2.UnmarshalBinary() modified state on failure", i)
+		}
+	}
+}
+
+func TestMarshalSealed(t *testing.T) {
+	disableReuseDetector(t)
+
+	h, key, m := newTestInstance(t)
+	h.Write(m[:123])
+
+	sealKey := bytes.Repeat([]byte{0x42}, SealKeySize)
+	b, err := h.MarshalSealed(sealKey)
+	if err != nil {
+		t.Fatalf("h.MarshalSealed(): %s", err)
+	}
+	plain, _ := h.MarshalBinary()
+	if bytes.Contains(b, plain[stateHeaderSize:stateHeaderSize+16]) {
+		t.Fatalf("h.MarshalSealed() leaked the key")
+	}
+
+	var h2 Poly1305
+	if err = h2.UnmarshalSealed(sealKey, b); err != nil {
+		t.Fatalf("h2.UnmarshalSealed(): %s", err)
+	}
+	h2.Write(m[123:])
+	var expected [Size]byte
+	Sum(&expected, m, key)
+	if mac := h2.Sum(nil); !bytes.Equal(mac, expected[:]) {
+		t.Errorf("restored mac != expected")
+	}
+
+	var h3 Poly1305
+	if err = h3.UnmarshalSealed(sealKey[:16], b); err != ErrInvalidKeySize {
+		t.Errorf("h3.UnmarshalSealed(short key): %v", err)
+	}
+	if err = h3.UnmarshalSealed(sealKey, b[1:]); err != ErrStateTruncated {
+		t.Errorf("h3.UnmarshalSealed(truncated): %v", err)
+	}
+	sealKey[0] ^= 1
+	if err = h3.UnmarshalSealed(sealKey, b); err != ErrStateAuthentication {
+		t.Errorf("h3.UnmarshalSealed(wrong key): %v", err)
+	}
+	sealKey[0] ^= 1
+	b[len(b)-1] ^= 1
+	if err = h3.UnmarshalSealed(sealKey, b); err != ErrStateAuthentication {
+		t.Errorf("h3.UnmarshalSealed(tampered): %v", err)
+	}
+}
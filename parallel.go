@@ -0,0 +1,91 @@
+//
+// parallel.go: Multi-core Poly1305.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/Yawning/poly1305/internal/field"
+)
+
+// minParallelChunkSize is the smallest chunk that SumParallel will hand to a
+// worker, below which the goroutine overhead dominates.
+const minParallelChunkSize = 64 * 1024
+
+// SumParallel is Sum, with the message split into block aligned chunks that
+// are processed concurrently by up to workers goroutines (GOMAXPROCS if
+// workers <= 0).  The result is identical to that of Sum.  Messages too
+// short to benefit are processed by the calling goroutine.
+func SumParallel(mac *[Size]byte, m []byte, key *[KeySize]byte, workers int) {
+	requireSelfTest()
+	checkKeyReuse(reuseRoleTag, key[:])
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	sumParallel(mac, m, key, workers, minParallelChunkSize)
+}
+
+func sumParallel(mac *[Size]byte, m []byte, key *[KeySize]byte, workers, minChunkSize int) {
+	var st Poly1305
+	nBlocks := len(m) / BlockSize
+	if maxWorkers := nBlocks / (minChunkSize / BlockSize); workers > maxWorkers {
+		workers = maxWorkers
+	}
+	if workers <= 1 {
+		sum(&st, mac, m, key)
+		return
+	}
+
+	// Every chunk is chunkBlocks long, except for the last, which also gets
+	// the remaining full blocks.  The trailing partial block is processed
+	// normally at the end.
+	st.rekey(key[:])
+	chunkBlocks := nBlocks / workers
+	lastBlocks := nBlocks - chunkBlocks*(workers-1)
+	hs := make([]field.Element, workers)
+
+	var wg sync.WaitGroup
+	for i := range hs {
+		start, n := i*chunkBlocks*BlockSize, chunkBlocks*BlockSize
+		if i == workers-1 {
+			n = lastBlocks * BlockSize
+		}
+		wg.Add(1)
+		go func(h *field.Element, chunk []byte, r field.Element) {
+			defer wg.Done()
+			impl := implState{r: r}
+			impl.blocks(chunk, len(chunk), false)
+			*h = impl.hElement()
+			impl.clear()
+		}(&hs[i], m[start:start+n], st.impl.r)
+	}
+	wg.Wait()
+
+	// h = ((h_0 * r^chunkBlocks + h_1) * r^chunkBlocks + ...) * r^lastBlocks + h_last
+	var rChunk, rLast field.Element
+	rChunk.Pow(&st.impl.r, uint64(chunkBlocks))
+	rLast.Pow(&st.impl.r, uint64(lastBlocks))
+	h := &st.impl.h
+	h.Set(&hs[0])
+	for i := 1; i < workers; i++ {
+		rPow := &rChunk
+		if i == workers-1 {
+			rPow = &rLast
+		}
+		h.Mul(h, rPow).Add(h, &hs[i])
+	}
+
+	st.update(m[nBlocks*BlockSize:])
+	st.finish(mac)
+
+	for i := range hs {
+		hs[i].Zero()
+	}
+}
@@ -0,0 +1,64 @@
+//
+// parallel_test.go: Multi-core Poly1305 tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"math/rand/v2"
+	"testing"
+)
+
+func TestSumParallel(t *testing.T) {
+	disableReuseDetector(t)
+
+	rng := rand.New(rand.NewPCG(1305, 11))
+
+	m := make([]byte, 4*minParallelChunkSize+23)
+	for i := range m {
+		m[i] = byte(rng.Uint32())
+	}
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(rng.Uint32())
+	}
+
+	for iter := 0; iter < 200; iter++ {
+		msg := m[:rng.IntN(4096)]
+		workers := 1 + rng.IntN(9)
+
+		var expected, mac [Size]byte
+		Sum(&expected, msg, &key)
+		sumParallel(&mac, msg, &key, workers, BlockSize)
+		if mac != expected {
+			t.Fatalf("[%d]: sumParallel(%d bytes, %d workers) != Sum()", iter, len(msg), workers)
+		}
+	}
+
+	var expected [Size]byte
+	Sum(&expected, m, &key)
+	for _, workers := range []int{-1, 0, 1, 2, 3, 4, 16} {
+		var mac [Size]byte
+		SumParallel(&mac, m, &key, workers)
+		if mac != expected {
+			t.Errorf("SumParallel(%d workers) != Sum()", workers)
+		}
+	}
+}
+
+// Run with -cpu 1,2,4,... to see the scaling with GOMAXPROCS.
+func BenchmarkSumParallel(b *testing.B) {
+	var mac [Size]byte
+	var key [KeySize]byte
+	m := make([]byte, 16*1024*1024)
+	b.SetBytes(int64(len(m)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		SumParallel(&mac, m, &key, 0)
+	}
+}
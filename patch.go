@@ -0,0 +1,130 @@
+//
+// patch.go: Poly1305 tag updates after in-place block edits.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/Yawning/poly1305/internal/field"
+)
+
+// ErrInvalidBlock is the error returned when a block index is out of range,
+// or when a block has the wrong size for its index.
+var ErrInvalidBlock = errors.New("poly1305: invalid block index or size")
+
+// Patchable is the MAC state of a message, that allows the tag to be updated
+// after in-place edits to individual blocks of the message without rehashing
+// the unchanged data.  Patching a message and releasing both tags reuses the
+// one-time key, so this is only suitable for protocols where that is
+// acceptable (eg: when only the final tag is ever released).
+//
+// Since the tag is linear in the message blocks, editing the i-th of n
+// blocks from c to c' changes the accumulator by (c' - c) * r^(n-i).
+type Patchable struct {
+	impl    implState
+	nBlocks uint64
+	tailLen int
+}
+
+// NewPatchable returns a new Patchable for the message m, keyed with the
+// supplied key.
+func NewPatchable(key []byte, m []byte) (*Patchable, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKeySize
+	}
+	if err := checkSelfTest(); err != nil {
+		return nil, err
+	}
+	checkKeyReuse(reuseRoleTag, key)
+
+	var st Poly1305
+	st.rekey(key)
+	st.update(m)
+
+	p := &Patchable{
+		nBlocks: uint64((len(m) + BlockSize - 1) / BlockSize),
+		tailLen: st.leftover,
+	}
+
+	// Process the final block the same way finish does.
+	if st.leftover > 0 {
+		st.buffer[st.leftover] = 1
+		for i := st.leftover + 1; i < BlockSize; i++ {
+			st.buffer[i] = 0
+		}
+		st.impl.blocks(st.buffer[:], BlockSize, true)
+	}
+	p.impl = st.impl
+	p.impl.unpack64()
+	st.Clear()
+
+	return p, nil
+}
+
+// Update updates the tag for the replacement of the index-th block of the
+// message, from oldBlock to newBlock.  Every block is BlockSize bytes,
+// except for the last, which is as long as the message's trailing partial
+// block, if any.  The tag will be incorrect if oldBlock is not the current
+// contents of the block.
+func (p *Patchable) Update(index uint64, oldBlock, newBlock []byte) error {
+	blockLen := BlockSize
+	if index == p.nBlocks-1 && p.tailLen > 0 {
+		blockLen = p.tailLen
+	}
+	if index >= p.nBlocks || len(oldBlock) != blockLen || len(newBlock) != blockLen {
+		return ErrInvalidBlock
+	}
+
+	// h += (c' - c) * r^(n-i)
+	var d, rPow field.Element
+	oldC, newC := blockElement(oldBlock), blockElement(newBlock)
+	d.Sub(&newC, &oldC)
+	rPow.Pow(&p.impl.r, p.nBlocks-index)
+	d.Mul(&d, &rPow)
+	p.impl.h.Add(&p.impl.h, &d)
+
+	return nil
+}
+
+// SumTo writes the tag of the current message to out.
+func (p *Patchable) SumTo(out *[Size]byte) {
+	impl := p.impl
+	impl.finish(out)
+	impl.clear()
+}
+
+// Clear purges the sensitive material in the state.
+func (p *Patchable) Clear() {
+	p.impl.clear()
+	p.nBlocks = 0
+	p.tailLen = 0
+}
+
+// blockElement returns a message block as the field element that blocks()
+// adds to the accumulator, with partial blocks padded as done by finish.
+func blockElement(b []byte) field.Element {
+	var buf [BlockSize]byte
+	var hibit uint32
+	if copy(buf[:], b) == BlockSize {
+		hibit = 1 << 24
+	} else {
+		buf[len(b)] = 1
+	}
+
+	var c field.Element
+	c.SetLimbs(&[5]uint32{
+		binary.LittleEndian.Uint32(buf[0:]) & 0x3ffffff,
+		(binary.LittleEndian.Uint32(buf[3:]) >> 2) & 0x3ffffff,
+		(binary.LittleEndian.Uint32(buf[6:]) >> 4) & 0x3ffffff,
+		(binary.LittleEndian.Uint32(buf[9:]) >> 6) & 0x3ffffff,
+		(binary.LittleEndian.Uint32(buf[12:]) >> 8) | hibit,
+	})
+	return c
+}
@@ -0,0 +1,94 @@
+//
+// patch_test.go: Poly1305 tag update tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzPatchable(f *testing.F) {
+	disableReuseDetector(f)
+
+	f.Add([]byte("key"), []byte("a short message"), uint64(0), []byte("A"))
+	f.Add([]byte{0xff}, bytes.Repeat([]byte{0xff}, 64), uint64(3), bytes.Repeat([]byte{0x00}, 16))
+	f.Add([]byte{}, bytes.Repeat([]byte{0x5a}, 100), uint64(6), []byte("edit"))
+	f.Add([]byte{0x01}, bytes.Repeat([]byte{0x00}, 48), uint64(1), bytes.Repeat([]byte{0xff}, 16))
+
+	f.Fuzz(func(t *testing.T, keySeed, m []byte, index uint64, edit []byte) {
+		if len(m) == 0 {
+			return
+		}
+		var key [KeySize]byte
+		for i := range key {
+			key[i] = byte(i)
+		}
+		copy(key[:], keySeed)
+
+		p, err := NewPatchable(key[:], m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Apply two edits at derived indexes, to cover repeated updates.
+		m = append([]byte{}, m...)
+		nBlocks := uint64(len(m)+BlockSize-1) / BlockSize
+		for _, idx := range []uint64{index % nBlocks, (index / 7) % nBlocks} {
+			start := int(idx) * BlockSize
+			end := min(start+BlockSize, len(m))
+			newBlock := make([]byte, end-start)
+			copy(newBlock, m[start:end])
+			for i, v := range edit {
+				newBlock[i%len(newBlock)] ^= v
+			}
+
+			if err = p.Update(idx, m[start:end], newBlock); err != nil {
+				t.Fatalf("p.Update(%d): %s", idx, err)
+			}
+			copy(m[start:end], newBlock)
+
+			var expected, mac [Size]byte
+			Sum(&expected, m, &key)
+			p.SumTo(&mac)
+			if mac != expected {
+				t.Fatalf("patched tag != Sum(patched m) (index: %d, len: %d)", idx, len(m))
+			}
+		}
+	})
+}
+
+func TestPatchableErrors(t *testing.T) {
+	var key [KeySize]byte
+	m := make([]byte, 40)
+	p, err := NewPatchable(key[:], m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, vec := range []struct {
+		index    uint64
+		old, new int
+	}{
+		{3, 8, 8},
+		{2, 16, 16},
+		{0, 8, 8},
+		{1, 16, 15},
+		{1, 15, 16},
+	} {
+		if err = p.Update(vec.index, m[:vec.old], m[:vec.new]); err != ErrInvalidBlock {
+			t.Errorf("[%d]: p.Update(): %v (expected: ErrInvalidBlock)", i, err)
+		}
+	}
+	if err = p.Update(2, m[:8], m[:8]); err != nil {
+		t.Errorf("p.Update(tail): %s", err)
+	}
+	if _, err = NewPatchable(key[:16], m); err != ErrInvalidKeySize {
+		t.Errorf("NewPatchable(short key): %v (expected: ErrInvalidKeySize)", err)
+	}
+}
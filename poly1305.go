@@ -10,15 +10,17 @@
 // golang.org/x/crypto implementation in that it exports a hash.Hash interface
 // to support incremental updates.
 //
-// The implementation is based on Andrew Moon's poly1305-donna.
+// The implementation is based on Andrew Moon's poly1305-donna.  Building
+// with the purego build tag excludes the assembly backends and every use of
+// the unsafe package, at the cost of NewLocked.
 package poly1305
 
 import (
 	"crypto/subtle"
 	"errors"
 	"hash"
-	"runtime"
-	"unsafe"
+	"io"
+	"sync"
 )
 
 const (
@@ -30,6 +32,12 @@ const (
 
 	// BlockSize is the Poly1305 block size in bytes.
 	BlockSize = 16
+
+	readFromBufferSize = 32 * 1024
+
+	// shortMessageSize is the longest message that Sum and Verify process
+	// without a Poly1305 instance, see sumShort.
+	shortMessageSize = 64
 )
 
 var (
@@ -41,25 +49,138 @@ var (
 	// encountered.
 	ErrInvalidMacSize = errors.New("poly1305: invalid mac size")
 
-	isLittleEndian = false
+	// ErrMacMismatch is the error returned when a MAC fails to verify.
+	ErrMacMismatch = errors.New("poly1305: mac mismatch")
+
+	// ErrFinalized is the error returned when a hash instance is used after
+	// Finalize has been called.
+	ErrFinalized = errors.New("poly1305: instance already finalized")
+
+	// ErrNotKeyed is the error returned when a hash instance is used after
+	// Reset, before a fresh key is supplied via Init or Rekey.
+	ErrNotKeyed = errors.New("poly1305: instance is not keyed")
 )
 
-type implInterface interface {
-	init(key []byte)
-	clear()
-	blocks(m []byte, bytes int, isFinal bool)
-	finish(mac *[Size]byte)
-}
+type instanceStatus uint8
+
+const (
+	statusKeyed instanceStatus = iota
+	statusUnkeyed
+	statusFinalized
+)
 
 // Poly1305 is an instance of the Poly1305 MAC algorithm.
+//
+// Poly1305 must not contain any pointers (including slices, strings, maps
+// and interfaces), as NewLocked places instances in memory that the garbage
+// collector does not scan.  TestPoly1305PointerFree enforces this.
 type Poly1305 struct {
-	impl     implState
-	leftover int
-	buffer   [BlockSize]byte
+	impl       implState
+	leftover   int
+	buffer     [BlockSize]byte
+	status     instanceStatus
+	resettable bool
+	tagSize    int
 }
 
-// Write adds more data to the running hash.  It never returns an error.
+// Write adds more data to the running hash.  It only returns an error if the
+// instance has been finalized or is not keyed.
 func (st *Poly1305) Write(p []byte) (n int, err error) {
+	if err = st.statusErr(); err != nil {
+		return 0, err
+	}
+
+	st.update(p)
+	return len(p), nil
+}
+
+// WriteVectors adds the concatenation of bufs (eg: a net.Buffers) to the
+// running hash, without copying anything other than the partial blocks that
+// straddle the boundaries between buffers.  The aligned middle of each
+// buffer is processed in place, and unlike a Write loop, the instance is
+// only checked once.  It only returns an error if the instance has been
+// finalized or is not keyed.
+func (st *Poly1305) WriteVectors(bufs [][]byte) (n int64, err error) {
+	if err = st.statusErr(); err != nil {
+		return 0, err
+	}
+
+	for _, b := range bufs {
+		n += int64(len(b))
+
+		// Complete the block carried over from the previous buffers.
+		if st.leftover > 0 {
+			c := copy(st.buffer[st.leftover:], b)
+			st.leftover += c
+			b = b[c:]
+			if st.leftover < BlockSize {
+				continue
+			}
+			st.impl.blocks(st.buffer[:], BlockSize, false)
+			st.leftover = 0
+		}
+
+		if want := len(b) &^ (BlockSize - 1); want > 0 {
+			st.impl.blocks(b, want, false)
+			b = b[want:]
+		}
+		st.leftover = copy(st.buffer[:], b)
+	}
+	return n, nil
+}
+
+// readFromPool is the pool of ReadFrom buffers, which are only wiped as far
+// as they were used, so that short readers do not pay for the whole buffer.
+var readFromPool = sync.Pool{
+	New: func() any {
+		return new([readFromBufferSize]byte)
+	},
+}
+
+// ReadFrom adds data read from r until EOF or error to the running hash,
+// reading into a large block aligned buffer that is processed in place.  Any
+// error except io.EOF encountered during the read is returned, after the data
+// read prior to the error is added to the running hash.
+func (st *Poly1305) ReadFrom(r io.Reader) (n int64, err error) {
+	if err = st.statusErr(); err != nil {
+		return 0, err
+	}
+
+	bufp := readFromPool.Get().(*[readFromBufferSize]byte)
+	buf, used := bufp[:], 0
+	defer func() {
+		burnBytes(buf[:used])
+		readFromPool.Put(bufp)
+	}()
+
+	// Start with the leftover, so that all of the reads are block aligned.
+	off := copy(buf, st.buffer[:st.leftover])
+	burnBytes(st.buffer[:])
+	st.leftover = 0
+	for {
+		var nr int
+		nr, err = r.Read(buf[off:])
+		n += int64(nr)
+		off += nr
+		used = max(used, off)
+
+		if want := off &^ (BlockSize - 1); want > 0 && (off == len(buf) || err != nil) {
+			st.impl.blocks(buf, want, false)
+			off = copy(buf, buf[want:off])
+		}
+		if err != nil {
+			break
+		}
+	}
+	st.leftover = copy(st.buffer[:], buf[:off])
+
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (st *Poly1305) update(p []byte) {
 	//
 	// poly1305-donna.c:poly1305_update()
 	//
@@ -80,7 +201,7 @@ func (st *Poly1305) Write(p []byte) (n int, err error) {
 		m = m[want:]
 		st.leftover += want
 		if st.leftover < BlockSize {
-			return len(p), nil
+			return
 		}
 		st.impl.blocks(st.buffer[:], BlockSize, false)
 		st.leftover = 0
@@ -101,31 +222,122 @@ func (st *Poly1305) Write(p []byte) (n int, err error) {
 		}
 		st.leftover += bytes
 	}
-
-	return len(p), nil
 }
 
-// Sum appends the current hash to b and returns the resulting slice.  It does
-// not change the underlying hash state.
+// Sum appends the current hash, truncated to the tag size (see SetTagSize),
+// to b and returns the resulting slice.  It does not change the underlying
+// hash state.  It panic()s with ErrFinalized or ErrNotKeyed if the instance
+// has been finalized or is not keyed.
 func (st *Poly1305) Sum(b []byte) []byte {
+	if err := st.statusErr(); err != nil {
+		panic(err)
+	}
+
+	var mac [Size]byte
+	var tmp Poly1305
+	st.sum(&tmp, &mac)
+	return append(b, mac[:st.Size()]...)
+}
+
+// SumTo writes the current hash to out.  It does not change the underlying
+// hash state, and unlike Sum, does not allocate.  It panic()s with
+// ErrFinalized or ErrNotKeyed if the instance has been finalized or is not
+// keyed.
+func (st *Poly1305) SumTo(out *[Size]byte) {
+	if err := st.statusErr(); err != nil {
+		panic(err)
+	}
+
+	var tmp Poly1305
+	st.sum(&tmp, out)
+}
+
+// Verify returns true iff tag is the current hash, in constant time.  It does
+// not change the underlying hash state.  Tags that are not of the tag size
+// are rejected, see SetTagSize and VerifyTag.  It panic()s with ErrFinalized
+// or ErrNotKeyed if the instance has been finalized or is not keyed.
+func (st *Poly1305) Verify(tag []byte) bool {
+	switch err := st.VerifyTag(tag); err {
+	case nil:
+		return true
+	case ErrInvalidMacSize, ErrMacMismatch:
+		return false
+	default:
+		panic(err)
+	}
+}
+
+// VerifyTag checks that tag is the current hash, in constant time, returning
+// ErrInvalidMacSize if tag is not of the tag size (see SetTagSize), and
+// ErrMacMismatch if it does not match.  It does not change the underlying
+// hash state.
+func (st *Poly1305) VerifyTag(tag []byte) error {
+	if err := st.statusErr(); err != nil {
+		return err
+	}
+	if len(tag) != st.Size() {
+		return ErrInvalidMacSize
+	}
+
 	var mac [Size]byte
+	var tmp Poly1305
+	st.sum(&tmp, &mac)
+	if !compareMAC(tag, &mac) {
+		return ErrMacMismatch
+	}
+	return nil
+}
+
+// Finalize writes the MAC to out and purges the sensitive material in the
+// hash's internal state.  Unlike Sum, this leaves the instance in a terminal
+// state, where Write, Sum and Finalize return or panic() with ErrFinalized
+// until the instance is re-initialized with Init.
+func (st *Poly1305) Finalize(out *[Size]byte) error {
+	if err := st.statusErr(); err != nil {
+		return err
+	}
+
+	st.finish(out)
+	st.status = statusFinalized
+	return nil
+}
+
+// Clone returns an independent copy of the hash instance, including the key
+// material.  It only returns an error if the instance has been finalized or
+// is not keyed.
+func (st *Poly1305) Clone() (hash.Cloner, error) {
+	if err := st.statusErr(); err != nil {
+		return nil, err
+	}
+
 	tmp := *st
-	tmp.finish(&mac)
-	return append(b, mac[:]...)
+	return &tmp, nil
 }
 
 // Reset clears the internal hash state and panic()s, because calling this is a
 // sign that the user is doing something unadvisable.
+//
+// Instances created with NewResettable instead are left unkeyed, with Write
+// and Sum returning or panic()ing with ErrNotKeyed until a fresh key is
+// supplied via Init or Rekey.
 func (st *Poly1305) Reset() {
 	st.Clear() // Obliterate the state before panic().
 
+	if st.resettable {
+		st.status = statusUnkeyed
+		return
+	}
+
 	// Poly1305 keys are one time use only.
 	panic("poly1305: Reset() is not supported")
 }
 
 // Size returns the number of bytes Sum will return.
 func (st *Poly1305) Size() int {
-	return Size
+	if st.tagSize == 0 {
+		return Size
+	}
+	return st.tagSize
 }
 
 // BlockSize returns the hash's underlying block size.
@@ -135,17 +347,51 @@ func (st *Poly1305) BlockSize() int {
 
 // Init (re-)initializes the hash instance with a given key.
 func (st *Poly1305) Init(key []byte) {
+	if err := st.Rekey(key); err != nil {
+		panic(err)
+	}
+}
+
+// Rekey (re-)initializes the hash instance with a given key.  It is identical
+// to Init, except that it returns ErrInvalidKeySize (or the self-test error,
+// see EnableSelfTestOnFirstUse) instead of panic()ing.
+func (st *Poly1305) Rekey(key []byte) error {
 	if len(key) != KeySize {
-		panic(ErrInvalidKeySize)
+		return ErrInvalidKeySize
+	}
+	if err := checkSelfTest(); err != nil {
+		return err
 	}
 
+	checkKeyReuse(reuseRoleTag, key)
+	st.rekey(key)
+	return nil
+}
+
+func (st *Poly1305) rekey(key []byte) {
+	st.Clear()
 	st.impl.init(key)
-	st.leftover = 0
+	st.status = statusKeyed
 }
 
-// Clear purges the sensitive material in hash's internal state.
+// Clear purges the sensitive material in hash's internal state, including any
+// buffered message bytes.
 func (st *Poly1305) Clear() {
 	st.impl.clear()
+	st.leftover = 0
+	for i := range st.buffer {
+		st.buffer[i] = 0
+	}
+}
+
+func (st *Poly1305) statusErr() error {
+	switch st.status {
+	case statusUnkeyed:
+		return ErrNotKeyed
+	case statusFinalized:
+		return ErrFinalized
+	}
+	return nil
 }
 
 func (st *Poly1305) finish(mac *[Size]byte) {
@@ -159,7 +405,14 @@ func (st *Poly1305) finish(mac *[Size]byte) {
 	}
 
 	st.impl.finish(mac)
-	st.impl.clear()
+	st.Clear()
+}
+
+// sum writes the MAC of the current state to mac, using tmp as scratch space
+// that is purged before returning.
+func (st *Poly1305) sum(tmp *Poly1305, mac *[Size]byte) {
+	*tmp = *st
+	tmp.finish(mac)
 }
 
 // New returns a new Poly1305 instance keyed with the supplied key.
@@ -167,41 +420,84 @@ func New(key []byte) (*Poly1305, error) {
 	if len(key) != KeySize {
 		return nil, ErrInvalidKeySize
 	}
+	if err := checkSelfTest(); err != nil {
+		return nil, err
+	}
 
+	checkKeyReuse(reuseRoleTag, key)
 	h := &Poly1305{}
-	h.Init(key)
+	h.rekey(key)
+	return h, nil
+}
+
+// NewResettable returns a new Poly1305 instance keyed with the supplied key,
+// that supports Reset, for use with code that pools hash.Hash instances.  See
+// Reset for details.
+func NewResettable(key []byte) (*Poly1305, error) {
+	h, err := New(key)
+	if err != nil {
+		return nil, err
+	}
+	h.resettable = true
 	return h, nil
 }
 
 // Sum does exactly what golang.org/x/crypto/poly1305.Sum() does.
 func Sum(mac *[Size]byte, m []byte, key *[KeySize]byte) {
+	requireSelfTest()
+	checkKeyReuse(reuseRoleTag, key[:])
+	sumOneShot(mac, m, key)
+}
+
+// Verify does exactly what golang.org/x/crypto/poly1305.Verify does.
+func Verify(mac *[Size]byte, m []byte, key *[KeySize]byte) bool {
+	requireSelfTest()
+	checkKeyReuse(reuseRoleVerify, key[:])
+
+	if len(m) <= shortMessageSize {
+		var m2 [Size]byte
+		sumShort(&m2, m, key)
+		return compareMAC(mac[:], &m2)
+	}
 	var h Poly1305
-	h.Init(key[:])
+	return verify(&h, mac, m, key)
+}
+
+// sumOneShot is Sum, without the key reuse check.
+func sumOneShot(mac *[Size]byte, m []byte, key *[KeySize]byte) {
+	if len(m) <= shortMessageSize {
+		sumShort(mac, m, key)
+		return
+	}
+	var h Poly1305
+	sum(&h, mac, m, key)
+}
+
+// sum is Sum, using h as scratch space that is purged before returning.
+func sum(h *Poly1305, mac *[Size]byte, m []byte, key *[KeySize]byte) {
+	h.rekey(key[:])
 	h.Write(m)
 	h.finish(mac)
 }
 
-// Verify does exactly what golang.org/x/crypto/poly1305.Verify does.
-func Verify(mac *[Size]byte, m []byte, key *[KeySize]byte) bool {
+// verify is Verify, using h as scratch space that is purged before returning.
+func verify(h *Poly1305, mac *[Size]byte, m []byte, key *[KeySize]byte) bool {
 	var m2 [Size]byte
-	Sum(&m2, m, key)
-	return subtle.ConstantTimeCompare(mac[:], m2[:]) == 1
-}
-
-func init() {
-	// Use the UTF-32 (UCS-4) Byte Order Mark to detect host byte order,
-	// which enables the further use of 'unsafe' for added performance.
-	const bomLE = 0x0000feff
-	bom := [4]byte{0xff, 0xfe, 0x00, 0x00}
-
-	// ARM doesn't get the spiffy fast code since it's picky wrt alignment
-	// and I doubt Go does the right thing.
-	if runtime.GOARCH != "arm" {
-		bomHost := *(*uint32)(unsafe.Pointer(&bom[0]))
-		if bomHost == 0x0000feff { // Little endian, use unsafe.
-			isLittleEndian = true
-		}
+	sum(h, &m2, m, key)
+	return compareMAC(mac[:], &m2)
+}
+
+// compareMAC returns true iff tag is a prefix of mac, in constant time, and
+// purges mac.
+func compareMAC(tag []byte, mac *[Size]byte) bool {
+	ok := subtle.ConstantTimeCompare(tag, mac[:len(tag)]) == 1
+	for i := range mac {
+		mac[i] = 0
 	}
+	return ok
 }
 
-var _ hash.Hash = (*Poly1305)(nil)
+var (
+	_ hash.Hash   = (*Poly1305)(nil)
+	_ hash.Cloner = (*Poly1305)(nil)
+)
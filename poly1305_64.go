@@ -0,0 +1,208 @@
+//
+// poly1305_64.go: 64->128 bit multiplies, 64 bit additions
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"github.com/Yawning/poly1305/internal/field"
+)
+
+// implMul64 is the math/bits backend, with h as two 64 bit limbs and a
+// small carry limb, and r as two 64 bit limbs.  The limbs are kept in
+// h64 and r64 across calls, and are only converted back to the field
+// elements in implState when the state is used by something else, see
+// unpack64.
+type implMul64 implState
+
+type uint128 struct {
+	lo, hi uint64
+}
+
+func mul64(a, b uint64) uint128 {
+	hi, lo := bits.Mul64(a, b)
+	return uint128{lo, hi}
+}
+
+func add128(a, b uint128) uint128 {
+	lo, c := bits.Add64(a.lo, b.lo, 0)
+	hi, _ := bits.Add64(a.hi, b.hi, c)
+	return uint128{lo, hi}
+}
+
+func (impl *implMul64) init(key []byte) {
+	// r &= 0xffffffc0ffffffc0ffffffc0fffffff
+	r0 := binary.LittleEndian.Uint64(key[0:]) & 0x0ffffffc0fffffff
+	r1 := binary.LittleEndian.Uint64(key[8:]) & 0x0ffffffc0ffffffc
+	store64(&impl.r, r0, r1, 0)
+
+	// h = 0
+	impl.h.Zero()
+
+	// save pad for later
+	impl.pad[0] = binary.LittleEndian.Uint32(key[16:])
+	impl.pad[1] = binary.LittleEndian.Uint32(key[20:])
+	impl.pad[2] = binary.LittleEndian.Uint32(key[24:])
+	impl.pad[3] = binary.LittleEndian.Uint32(key[28:])
+}
+
+func (impl *implMul64) clear() {
+	impl.h.Zero()
+	impl.r.Zero()
+	for i := range impl.pad {
+		impl.pad[i] = 0
+	}
+	for i := range impl.rPow {
+		impl.rPow[i].Zero()
+	}
+}
+
+func (impl *implMul64) blocks(m []byte, bytes int, isFinal bool) {
+	var hibit uint64
+	if !isFinal {
+		hibit = 1 // 1 << 128
+	}
+
+	if !impl.is64 {
+		impl.h64[0], impl.h64[1], impl.h64[2] = load64(&impl.h)
+		impl.r64[0], impl.r64[1], _ = load64(&impl.r)
+		impl.h.Zero()
+		impl.is64 = true
+	}
+	blocks64(&impl.h64, impl.r64[0], impl.r64[1], m[:bytes], hibit)
+}
+
+func (impl *implMul64) finish(mac *[Size]byte) {
+	h0, h1, h2 := impl.h64[0], impl.h64[1], impl.h64[2]
+	if !impl.is64 {
+		h0, h1, h2 = load64(&impl.h)
+	}
+	pad0 := uint64(impl.pad[0]) | uint64(impl.pad[1])<<32
+	pad1 := uint64(impl.pad[2]) | uint64(impl.pad[3])<<32
+	finish64(mac, h0, h1, h2, pad0, pad1)
+}
+
+// blocks64 processes the full blocks of m, with h as two 64 bit limbs and
+// a small carry limb, and r as two 64 bit limbs.  h is left partially
+// reduced, at most 2 * p.
+func blocks64(h *[3]uint64, r0, r1 uint64, m []byte, hibit uint64) {
+	var c uint64
+
+	// The clamping of r leaves the top 4 bits of r0 and r1 clear, which
+	// keeps h2 * r0 and h2 * r1 inside of 64 bits, and leaves room for the
+	// sums of the partial products.
+	h0, h1, h2 := h[0], h[1], h[2]
+
+	for len(m) >= BlockSize {
+		// h += m[i]
+		h0, c = bits.Add64(h0, binary.LittleEndian.Uint64(m[0:]), 0)
+		h1, c = bits.Add64(h1, binary.LittleEndian.Uint64(m[8:]), c)
+		h2 += c + hibit
+
+		// h *= r
+		d0 := mul64(h0, r0)
+		d1 := add128(mul64(h0, r1), mul64(h1, r0))
+		d2 := add128(mul64(h1, r1), uint128{h2 * r0, 0})
+		d3 := h2 * r1
+
+		t0 := d0.lo
+		t1, c := bits.Add64(d1.lo, d0.hi, 0)
+		t2, c := bits.Add64(d2.lo, d1.hi, c)
+		t3, _ := bits.Add64(d3, d2.hi, c)
+
+		// (partial) h %= p, as h = (t % 2^130) + (t >> 130) * 5, computed
+		// as the sum of (t >> 130) * 4 and (t >> 130).
+		h0, h1, h2 = t0, t1, t2&3
+		cLo, cHi := t2&^3, t3
+
+		h0, c = bits.Add64(h0, cLo, 0)
+		h1, c = bits.Add64(h1, cHi, c)
+		h2 += c
+
+		cLo, cHi = (cLo>>2)|(cHi<<62), cHi>>2
+
+		h0, c = bits.Add64(h0, cLo, 0)
+		h1, c = bits.Add64(h1, cHi, c)
+		h2 += c
+
+		m = m[BlockSize:]
+	}
+
+	h[0], h[1], h[2] = h0, h1, h2
+}
+
+// finish64 writes the MAC of the partially reduced h to mac.
+func finish64(mac *[Size]byte, h0, h1, h2, pad0, pad1 uint64) {
+	// h % p, h = h % (2^128), as h - p iff that does not underflow, which
+	// is enough as the partially reduced h is less than 2 * p.
+	g0, b := bits.Sub64(h0, 0xfffffffffffffffb, 0)
+	g1, b := bits.Sub64(h1, 0xffffffffffffffff, b)
+	_, b = bits.Sub64(h2, 3, b)
+	mask := b - 1
+	h0 = h0&^mask | g0&mask
+	h1 = h1&^mask | g1&mask
+
+	// mac = (h + pad) % (2^128)
+	var c uint64
+	h0, c = bits.Add64(h0, pad0, 0)
+	h1, _ = bits.Add64(h1, pad1, c)
+
+	binary.LittleEndian.PutUint64(mac[0:], h0)
+	binary.LittleEndian.PutUint64(mac[8:], h1)
+}
+
+// sumShortMul64 is sumShort for the mul64 based backends.  The blocks are
+// processed by blocks64, with the padded final block going through the
+// same loop, and the state is kept in 64 bit limbs from the key to the MAC,
+// so that the field elements are never touched.
+func sumShortMul64(mac *[Size]byte, m []byte, key *[KeySize]byte) {
+	var h [3]uint64
+
+	// r &= 0xffffffc0ffffffc0ffffffc0fffffff
+	r0 := binary.LittleEndian.Uint64(key[0:]) & 0x0ffffffc0fffffff
+	r1 := binary.LittleEndian.Uint64(key[8:]) & 0x0ffffffc0ffffffc
+
+	n := len(m) &^ (BlockSize - 1)
+	if n > 0 {
+		blocks64(&h, r0, r1, m[:n], 1)
+	}
+	if len(m) > n {
+		var buf [BlockSize]byte
+		buf[copy(buf[:], m[n:])] = 1
+		blocks64(&h, r0, r1, buf[:], 0)
+		buf = [BlockSize]byte{}
+	}
+
+	pad0 := binary.LittleEndian.Uint64(key[16:])
+	pad1 := binary.LittleEndian.Uint64(key[24:])
+	finish64(mac, h[0], h[1], h[2], pad0, pad1)
+	h = [3]uint64{}
+}
+
+// load64 returns v fully reduced, as two 64 bit limbs and the 2 bit top limb.
+func load64(v *field.Element) (uint64, uint64, uint64) {
+	l := v.Limbs()
+	return uint64(l[0]) | uint64(l[1])<<26 | uint64(l[2])<<52,
+		uint64(l[2])>>12 | uint64(l[3])<<14 | uint64(l[4])<<40,
+		uint64(l[4] >> 24)
+}
+
+// store64 sets v to h0 + h1 * 2^64 + h2 * 2^128, where h2 is at most 7.
+func store64(v *field.Element, h0, h1, h2 uint64) {
+	v.SetLimbs(&[5]uint32{
+		uint32(h0) & 0x3ffffff,
+		uint32(h0>>26) & 0x3ffffff,
+		uint32((h0>>52)|(h1<<12)) & 0x3ffffff,
+		uint32(h1>>14) & 0x3ffffff,
+		uint32(h1>>40) | uint32(h2)<<24,
+	})
+}
+
+var _ implInterface = (*implMul64)(nil)
@@ -0,0 +1,142 @@
+//
+// poly1305_amd64.go: amd64 vectorized Poly1305
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+//go:build amd64 && gc && !purego
+
+package poly1305
+
+// avx2MinBytes is the shortest run of blocks that the AVX2 backend will
+// vectorize, below which the setup cost (mostly computing r^2 .. r^4 for a
+// fresh key) outweighs the gain.  Benchmarked for a one-shot Sum (best of 10
+// runs, ns/op, mul64 vs avx2):
+//
+//	 512 bytes: 484 vs 516
+//	 640 bytes: 590 vs 596
+//	 768 bytes: 731 vs 574
+//	1024 bytes: 904 vs 608
+//	4096 bytes: 3516 vs 1446
+const avx2MinBytes = 768
+
+// implAVX2 is the AVX2 backend, that processes 4 blocks at a time, with the
+// runs of blocks that are not a multiple of 4 blocks long handled by the
+// mul64 backend.  init, clear and finish are those of the mul64 backend.
+type implAVX2 implState
+
+//go:noescape
+func blocksAVX2(h *[5]uint32, m []byte, t *[5][4]uint32)
+
+func (impl *implAVX2) blocks(m []byte, bytes int, isFinal bool) {
+	if n := bytes &^ (4*BlockSize - 1); n >= avx2MinBytes && !isFinal {
+		var t [5][4]uint32
+		(*implState)(impl).powerTable(&t, 4, 2, 3, 1)
+
+		(*implState)(impl).unpack64()
+		h := impl.h.Limbs()
+		blocksAVX2(&h, m[:n], &t)
+		impl.h.SetLimbs(&h)
+
+		for i := range t {
+			t[i] = [4]uint32{}
+		}
+		m = m[n:]
+		bytes -= n
+	}
+
+	(*implMul64)(impl).blocks(m, bytes, isFinal)
+}
+
+// sse2MinBytes is the shortest run of blocks that the SSE2 backend will
+// vectorize, see avx2MinBytes.  Benchmarked for a one-shot Sum (best of 10
+// runs, ns/op, mul64 vs sse2):
+//
+//	 512 bytes: 484 vs 514
+//	 768 bytes: 731 vs 719
+//	1024 bytes: 904 vs 843
+//	1536 bytes: 1382 vs 1186
+//	4096 bytes: 3516 vs 2452
+//
+// The gain at 768 bytes is within the noise, so the cutoff is 1024 bytes.
+const sse2MinBytes = 1024
+
+// implSSE2 is the SSE2 backend, that processes 2 blocks at a time, with a
+// trailing odd block handled by the mul64 backend.  init, clear and finish
+// are those of the mul64 backend.
+type implSSE2 implState
+
+//go:noescape
+func blocksSSE2(h *[5]uint32, m []byte, t *[5][4]uint32)
+
+func (impl *implSSE2) blocks(m []byte, bytes int, isFinal bool) {
+	if n := bytes &^ (2*BlockSize - 1); n >= sse2MinBytes && !isFinal {
+		var t [5][4]uint32
+		(*implState)(impl).powerTable(&t, 2, 1)
+
+		(*implState)(impl).unpack64()
+		h := impl.h.Limbs()
+		blocksSSE2(&h, m[:n], &t)
+		impl.h.SetLimbs(&h)
+
+		for i := range t {
+			t[i] = [4]uint32{}
+		}
+		m = m[n:]
+		bytes -= n
+	}
+
+	(*implMul64)(impl).blocks(m, bytes, isFinal)
+}
+
+//go:noescape
+func blocksAVX2x4(h *[5][4]uint64, m *[4]*byte, n int, t *[5][4]uint32)
+
+func blocksBatchAVX2(lanes *[batchLanes]Poly1305, msgs [][]byte) int {
+	n := len(msgs[0])
+	for _, m := range msgs[1:] {
+		n = min(n, len(m))
+	}
+	if n &^= BlockSize - 1; n == 0 {
+		return 0
+	}
+
+	var h [5][4]uint64
+	var t [5][4]uint32
+	var m [4]*byte
+	for i := range lanes {
+		lanes[i].impl.unpack64()
+		hl, rl := lanes[i].impl.h.Limbs(), lanes[i].impl.r.Limbs()
+		for j := range h {
+			h[j][i], t[j][i] = uint64(hl[j]), rl[j]
+		}
+		m[i] = &msgs[i][0]
+	}
+
+	blocksAVX2x4(&h, &m, n, &t)
+
+	for i := range lanes {
+		var hl [5]uint32
+		for j := range h {
+			hl[j] = uint32(h[j][i])
+		}
+		lanes[i].impl.h.SetLimbs(&hl)
+	}
+	for j := range h {
+		h[j], t[j] = [4]uint64{}, [4]uint32{}
+	}
+
+	return n
+}
+
+// powerTable sets t[j][i] to limb j of r^e[i], where each e[i] is 1 .. 4.
+func (impl *implState) powerTable(t *[5][4]uint32, e ...int) {
+	for i, v := range e {
+		l := impl.power(v).Limbs()
+		for j := range t {
+			t[j][i] = l[j]
+		}
+	}
+}
@@ -0,0 +1,303 @@
+//
+// poly1305_avx2_amd64.s: AVX2 4-way Poly1305 blocks.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+//go:build amd64 && gc && !purego
+
+#include "textflag.h"
+
+// Each of the 4 64 bit lanes is an independent accumulator, with the 26 bit
+// limbs h0 .. h4 in Y0 .. Y4, and the lanes getting blocks 0, 2, 1 and 3 of
+// every 64 byte group (the order that VPUNPCK{L,H}QDQ leaves them in).
+// Every group but the last is added, and multiplied by r^4, and the last is
+// added, and multiplied by r^4, r^2, r^3 and r^1 for the respective lanes,
+// after which the sum of the lanes is h * r^n + m_1 * r^n + ... + m_n * r.
+//
+// Register usage:
+//   Y0 .. Y4   h0 .. h4
+//   Y5 .. Y9   d0 .. d4
+//   Y10, Y11   scratch
+//   Y12        0x3ffffff in every lane
+//   Y13        1 << 24 (1 << 128) in every lane
+//   Y14, Y15   message scratch
+//
+// Stack frame (32 bytes per entry, the multiplier in the low 32 bits of
+// each lane, as VPMULUDQ ignores the high 32 bits):
+//   0   .. 128  r^4 limbs r0 .. r4
+//   160 .. 256  5 * r^4 limbs s1 .. s4
+//   288 .. 416  last group limbs r0 .. r4
+//   448 .. 544  5 * last group limbs s1 .. s4
+
+// d = h * r, with r and s in memory.
+#define MUL(R0, R1, R2, R3, R4, S1, S2, S3, S4) \
+	VPMULUDQ R0, Y0, Y5;        \
+	VPMULUDQ R1, Y0, Y6;        \
+	VPMULUDQ R2, Y0, Y7;        \
+	VPMULUDQ R3, Y0, Y8;        \
+	VPMULUDQ R4, Y0, Y9;        \
+	VPMULUDQ S4, Y1, Y10;       \
+	VPADDQ   Y10, Y5, Y5;       \
+	VPMULUDQ R0, Y1, Y11;       \
+	VPADDQ   Y11, Y6, Y6;       \
+	VPMULUDQ R1, Y1, Y10;       \
+	VPADDQ   Y10, Y7, Y7;       \
+	VPMULUDQ R2, Y1, Y11;       \
+	VPADDQ   Y11, Y8, Y8;       \
+	VPMULUDQ R3, Y1, Y10;       \
+	VPADDQ   Y10, Y9, Y9;       \
+	VPMULUDQ S3, Y2, Y11;       \
+	VPADDQ   Y11, Y5, Y5;       \
+	VPMULUDQ S4, Y2, Y10;       \
+	VPADDQ   Y10, Y6, Y6;       \
+	VPMULUDQ R0, Y2, Y11;       \
+	VPADDQ   Y11, Y7, Y7;       \
+	VPMULUDQ R1, Y2, Y10;       \
+	VPADDQ   Y10, Y8, Y8;       \
+	VPMULUDQ R2, Y2, Y11;       \
+	VPADDQ   Y11, Y9, Y9;       \
+	VPMULUDQ S2, Y3, Y10;       \
+	VPADDQ   Y10, Y5, Y5;       \
+	VPMULUDQ S3, Y3, Y11;       \
+	VPADDQ   Y11, Y6, Y6;       \
+	VPMULUDQ S4, Y3, Y10;       \
+	VPADDQ   Y10, Y7, Y7;       \
+	VPMULUDQ R0, Y3, Y11;       \
+	VPADDQ   Y11, Y8, Y8;       \
+	VPMULUDQ R1, Y3, Y10;       \
+	VPADDQ   Y10, Y9, Y9;       \
+	VPMULUDQ S1, Y4, Y11;       \
+	VPADDQ   Y11, Y5, Y5;       \
+	VPMULUDQ S2, Y4, Y10;       \
+	VPADDQ   Y10, Y6, Y6;       \
+	VPMULUDQ S3, Y4, Y11;       \
+	VPADDQ   Y11, Y7, Y7;       \
+	VPMULUDQ S4, Y4, Y10;       \
+	VPADDQ   Y10, Y8, Y8;       \
+	VPMULUDQ R0, Y4, Y11;       \
+	VPADDQ   Y11, Y9, Y9
+
+// (partial) h = d % p
+#define CARRY \
+	VPSRLQ $26, Y5, Y10;  \
+	VPAND  Y12, Y5, Y0;   \
+	VPADDQ Y10, Y6, Y6;   \
+	VPSRLQ $26, Y6, Y10;  \
+	VPAND  Y12, Y6, Y1;   \
+	VPADDQ Y10, Y7, Y7;   \
+	VPSRLQ $26, Y7, Y10;  \
+	VPAND  Y12, Y7, Y2;   \
+	VPADDQ Y10, Y8, Y8;   \
+	VPSRLQ $26, Y8, Y10;  \
+	VPAND  Y12, Y8, Y3;   \
+	VPADDQ Y10, Y9, Y9;   \
+	VPSRLQ $26, Y9, Y10;  \
+	VPAND  Y12, Y9, Y4;   \
+	VPSLLQ $2, Y10, Y11;  \
+	VPADDQ Y11, Y10, Y10; \
+	VPADDQ Y10, Y0, Y0;   \
+	VPSRLQ $26, Y0, Y10;  \
+	VPAND  Y12, Y0, Y0;   \
+	VPADDQ Y10, Y1, Y1
+
+// h += the blocks with low and high halves in the lanes of Y14 and Y15.
+#define ADD_LIMBS \
+	VPAND  Y12, Y14, Y10; \
+	VPADDQ Y10, Y0, Y0;   \
+	VPSRLQ $26, Y14, Y10; \
+	VPAND  Y12, Y10, Y10; \
+	VPADDQ Y10, Y1, Y1;   \
+	VPSRLQ $52, Y14, Y10; \
+	VPSLLQ $12, Y15, Y11; \
+	VPOR   Y11, Y10, Y10; \
+	VPAND  Y12, Y10, Y10; \
+	VPADDQ Y10, Y2, Y2;   \
+	VPSRLQ $14, Y15, Y10; \
+	VPAND  Y12, Y10, Y10; \
+	VPADDQ Y10, Y3, Y3;   \
+	VPSRLQ $40, Y15, Y10; \
+	VPOR   Y13, Y10, Y10; \
+	VPADDQ Y10, Y4, Y4
+
+// h += m[i .. i+4], SI += 64
+#define ADD_MESSAGE \
+	VMOVDQU     0(SI), Y10;    \
+	VMOVDQU     32(SI), Y11;   \
+	VPUNPCKLQDQ Y11, Y10, Y14; \
+	VPUNPCKHQDQ Y11, Y10, Y15; \
+	ADD_LIMBS;                 \
+	ADDQ        $64, SI
+
+// r and 5 * r for limb j of the loop and last group multipliers.
+#define POWERS(j, loopR, lastR) \
+	VPBROADCASTD (j*16)(DX), Y10; \
+	VMOVDQU      Y10, loopR(SP);  \
+	VPMOVZXDQ    (j*16)(DX), Y11; \
+	VMOVDQU      Y11, lastR(SP)
+
+#define POWERS_S(j, loopR, loopS, lastR, lastS) \
+	POWERS(j, loopR, lastR);  \
+	VPSLLD  $2, Y10, Y14;     \
+	VPADDD  Y10, Y14, Y14;    \
+	VMOVDQU Y14, loopS(SP);   \
+	VPSLLQ  $2, Y11, Y15;     \
+	VPADDQ  Y11, Y15, Y15;    \
+	VMOVDQU Y15, lastS(SP)
+
+// r and 5 * r for limb j of the per-lane multipliers.
+#define LANE_POWERS_S(j, laneR, laneS) \
+	VPMOVZXDQ (j*16)(DX), Y10; \
+	VMOVDQU   Y10, laneR(SP);  \
+	VPSLLQ    $2, Y10, Y11;    \
+	VPADDQ    Y10, Y11, Y11;   \
+	VMOVDQU   Y11, laneS(SP)
+
+// h = sum of the lanes of h, written to OFF(AX).
+#define SUM_LANES(Y, X, OFF) \
+	VEXTRACTI128 $1, Y, X10; \
+	VPADDQ       X10, X, X;  \
+	VPSRLDQ      $8, X, X10; \
+	VPADDQ       X10, X, X;  \
+	VMOVD        X, OFF(AX)
+
+// func blocksAVX2(h *[5]uint32, m []byte, t *[5][4]uint32)
+//
+// h is the partially reduced accumulator, which is updated with the
+// partially reduced result.  len(m) must be a non-zero multiple of 64, and
+// t[j] must be limb j of r^4, r^2, r^3 and r^1.
+TEXT ·blocksAVX2(SB), 0, $576-40
+	MOVQ h+0(FP), AX
+	MOVQ m_base+8(FP), SI
+	MOVQ m_len+16(FP), CX
+	MOVQ t+32(FP), DX
+	SHRQ $6, CX
+
+	VPCMPEQD Y12, Y12, Y12
+	VPSRLQ   $63, Y12, Y13
+	VPSLLQ   $24, Y13, Y13
+	VPSRLQ   $38, Y12, Y12
+
+	POWERS(0, 0, 288)
+	POWERS_S(1, 32, 160, 320, 448)
+	POWERS_S(2, 64, 192, 352, 480)
+	POWERS_S(3, 96, 224, 384, 512)
+	POWERS_S(4, 128, 256, 416, 544)
+
+	// h goes in lane 0, the other lanes start at 0.
+	VMOVD 0(AX), X0
+	VMOVD 4(AX), X1
+	VMOVD 8(AX), X2
+	VMOVD 12(AX), X3
+	VMOVD 16(AX), X4
+
+	DECQ CX
+	JZ   last
+
+loop:
+	ADD_MESSAGE
+	MUL(0(SP), 32(SP), 64(SP), 96(SP), 128(SP), 160(SP), 192(SP), 224(SP), 256(SP))
+	CARRY
+	DECQ CX
+	JNZ  loop
+
+last:
+	ADD_MESSAGE
+	MUL(288(SP), 320(SP), 352(SP), 384(SP), 416(SP), 448(SP), 480(SP), 512(SP), 544(SP))
+	CARRY
+
+	SUM_LANES(Y0, X0, 0)
+	SUM_LANES(Y1, X1, 4)
+	SUM_LANES(Y2, X2, 8)
+	SUM_LANES(Y3, X3, 12)
+	SUM_LANES(Y4, X4, 16)
+
+	// Purge the powers of r from the stack and the registers.
+	VZEROALL
+	MOVQ $0, CX
+
+purge:
+	VMOVDQU Y0, 0(SP)(CX*1)
+	ADDQ    $32, CX
+	CMPQ    CX, $576
+	JNE     purge
+
+	VZEROUPPER
+	RET
+
+// func blocksAVX2x4(h *[5][4]uint64, m *[4]*byte, n int, t *[5][4]uint32)
+//
+// The multi-buffer variant, where lane i is the state of an independent
+// message m[i], with limb j of h in h[j][i] and of r in t[j][i].  Every
+// message is n bytes long, which must be a non-zero multiple of 16.
+//
+// Stack frame (as above):
+//   0   .. 128  per-lane limbs r0 .. r4
+//   160 .. 256  5 * per-lane limbs s1 .. s4
+TEXT ·blocksAVX2x4(SB), 0, $288-32
+	MOVQ h+0(FP), AX
+	MOVQ m+8(FP), BX
+	MOVQ n+16(FP), CX
+	MOVQ t+24(FP), DX
+	MOVQ 0(BX), R8
+	MOVQ 8(BX), R9
+	MOVQ 16(BX), R10
+	MOVQ 24(BX), R11
+	SHRQ $4, CX
+	XORQ SI, SI
+
+	VPCMPEQD Y12, Y12, Y12
+	VPSRLQ   $63, Y12, Y13
+	VPSLLQ   $24, Y13, Y13
+	VPSRLQ   $38, Y12, Y12
+
+	VPMOVZXDQ 0(DX), Y10
+	VMOVDQU   Y10, 0(SP)
+	LANE_POWERS_S(1, 32, 160)
+	LANE_POWERS_S(2, 64, 192)
+	LANE_POWERS_S(3, 96, 224)
+	LANE_POWERS_S(4, 128, 256)
+
+	VMOVDQU 0(AX), Y0
+	VMOVDQU 32(AX), Y1
+	VMOVDQU 64(AX), Y2
+	VMOVDQU 96(AX), Y3
+	VMOVDQU 128(AX), Y4
+
+loopx4:
+	// Gather block i of each message, as (m[0], m[2]) and (m[1], m[3]),
+	// which VPUNPCK{L,H}QDQ turn into lanes 0 .. 3.
+	VMOVDQU     (R8)(SI*1), X10
+	VINSERTI128 $1, (R10)(SI*1), Y10, Y10
+	VMOVDQU     (R9)(SI*1), X11
+	VINSERTI128 $1, (R11)(SI*1), Y11, Y11
+	VPUNPCKLQDQ Y11, Y10, Y14
+	VPUNPCKHQDQ Y11, Y10, Y15
+	ADD_LIMBS
+	ADDQ        $16, SI
+
+	MUL(0(SP), 32(SP), 64(SP), 96(SP), 128(SP), 160(SP), 192(SP), 224(SP), 256(SP))
+	CARRY
+	DECQ CX
+	JNZ  loopx4
+
+	VMOVDQU Y0, 0(AX)
+	VMOVDQU Y1, 32(AX)
+	VMOVDQU Y2, 64(AX)
+	VMOVDQU Y3, 96(AX)
+	VMOVDQU Y4, 128(AX)
+
+	// Purge r from the stack and the registers.
+	VZEROALL
+	MOVQ $0, CX
+
+purgex4:
+	VMOVDQU Y0, 0(SP)(CX*1)
+	ADDQ    $32, CX
+	CMPQ    CX, $288
+	JNE     purgex4
+
+	VZEROUPPER
+	RET
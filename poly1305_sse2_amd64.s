@@ -0,0 +1,235 @@
+//
+// poly1305_sse2_amd64.s: SSE2 2-way Poly1305 blocks.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+//go:build amd64 && gc && !purego
+
+#include "textflag.h"
+
+// Each of the 2 64 bit lanes is an independent accumulator, with the 26 bit
+// limbs h0 .. h4 in X0 .. X4, and the lanes getting blocks 0 and 1 of every
+// 32 byte group.  Every group but the last is added, and multiplied by r^2,
+// and the last is added, and multiplied by r^2 and r^1 for the respective
+// lanes, after which the sum of the lanes is
+// h * r^n + m_1 * r^n + ... + m_n * r.
+//
+// Register usage:
+//   X0 .. X4   h0 .. h4
+//   X5 .. X9   d0 .. d4
+//   X10, X11   scratch
+//   X12        0x3ffffff in every lane
+//   X13        1 << 24 (1 << 128) in every lane
+//   X14, X15   message scratch
+//   BX         the 16 byte aligned tables on the stack
+//
+// Tables (16 bytes per entry, the multiplier in the low 32 bits of each
+// lane, as PMULULQ (PMULUDQ) ignores the high 32 bits):
+//   0   .. 64   r^2 limbs r0 .. r4
+//   80  .. 128  5 * r^2 limbs s1 .. s4
+//   144 .. 208  last group limbs r0 .. r4
+//   224 .. 272  5 * last group limbs s1 .. s4
+
+// d += h * r, with r in memory.
+#define MULADD(H, R, D) \
+	MOVO    H, X10;   \
+	PMULULQ R, X10;   \
+	PADDQ   X10, D
+
+// d = h * r, with r and s in memory.
+#define MUL(R0, R1, R2, R3, R4, S1, S2, S3, S4) \
+	MOVO    X0, X5;           \
+	PMULULQ R0, X5;           \
+	MOVO    X0, X6;           \
+	PMULULQ R1, X6;           \
+	MOVO    X0, X7;           \
+	PMULULQ R2, X7;           \
+	MOVO    X0, X8;           \
+	PMULULQ R3, X8;           \
+	MOVO    X0, X9;           \
+	PMULULQ R4, X9;           \
+	MULADD(X1, S4, X5);       \
+	MULADD(X1, R0, X6);       \
+	MULADD(X1, R1, X7);       \
+	MULADD(X1, R2, X8);       \
+	MULADD(X1, R3, X9);       \
+	MULADD(X2, S3, X5);       \
+	MULADD(X2, S4, X6);       \
+	MULADD(X2, R0, X7);       \
+	MULADD(X2, R1, X8);       \
+	MULADD(X2, R2, X9);       \
+	MULADD(X3, S2, X5);       \
+	MULADD(X3, S3, X6);       \
+	MULADD(X3, S4, X7);       \
+	MULADD(X3, R0, X8);       \
+	MULADD(X3, R1, X9);       \
+	MULADD(X4, S1, X5);       \
+	MULADD(X4, S2, X6);       \
+	MULADD(X4, S3, X7);       \
+	MULADD(X4, S4, X8);       \
+	MULADD(X4, R0, X9)
+
+// h = d, with limb j carried into limb j+1.
+#define CARRY_LIMB(D, DNEXT, H) \
+	MOVO  D, X10;   \
+	PSRLQ $26, X10; \
+	PAND  X12, D;   \
+	MOVO  D, H;     \
+	PADDQ X10, DNEXT
+
+// (partial) h = d % p
+#define CARRY \
+	CARRY_LIMB(X5, X6, X0); \
+	CARRY_LIMB(X6, X7, X1); \
+	CARRY_LIMB(X7, X8, X2); \
+	CARRY_LIMB(X8, X9, X3); \
+	MOVO  X9, X10;          \
+	PSRLQ $26, X10;         \
+	PAND  X12, X9;          \
+	MOVO  X9, X4;           \
+	MOVO  X10, X11;         \
+	PSLLQ $2, X11;          \
+	PADDQ X11, X10;         \
+	PADDQ X10, X0;          \
+	MOVO  X0, X10;          \
+	PSRLQ $26, X10;         \
+	PAND  X12, X0;          \
+	PADDQ X10, X1
+
+// h += m[i .. i+2], SI += 32
+#define ADD_MESSAGE \
+	MOVOU      0(SI), X14;   \
+	MOVOU      16(SI), X11;  \
+	MOVO       X14, X15;     \
+	PUNPCKLQDQ X11, X14;     \
+	PUNPCKHQDQ X11, X15;     \
+	MOVO       X14, X10;     \
+	PAND       X12, X10;     \
+	PADDQ      X10, X0;      \
+	MOVO       X14, X10;     \
+	PSRLQ      $26, X10;     \
+	PAND       X12, X10;     \
+	PADDQ      X10, X1;      \
+	PSRLQ      $52, X14;     \
+	MOVO       X15, X10;     \
+	PSLLQ      $12, X10;     \
+	POR        X14, X10;     \
+	PAND       X12, X10;     \
+	PADDQ      X10, X2;      \
+	MOVO       X15, X10;     \
+	PSRLQ      $14, X10;     \
+	PAND       X12, X10;     \
+	PADDQ      X10, X3;      \
+	PSRLQ      $40, X15;     \
+	POR        X13, X15;     \
+	PADDQ      X15, X4;      \
+	ADDQ       $32, SI
+
+// r for limb j of the loop and last group multipliers, with t[j] being
+// limb j of r^2 and r^1.
+#define POWERS(j, loopR, lastR) \
+	MOVOU  (j*16)(DX), X14;   \
+	PSHUFD $0x00, X14, X10;   \
+	MOVO   X10, loopR(BX);    \
+	PSHUFD $0x10, X14, X11;   \
+	MOVO   X11, lastR(BX)
+
+// r and 5 * r for limb j of the loop and last group multipliers.
+#define POWERS_S(j, loopR, loopS, lastR, lastS) \
+	POWERS(j, loopR, lastR); \
+	MOVO  X10, X14;          \
+	PSLLL $2, X14;           \
+	PADDL X10, X14;          \
+	MOVO  X14, loopS(BX);    \
+	MOVO  X11, X15;          \
+	PSLLL $2, X15;           \
+	PADDL X11, X15;          \
+	MOVO  X15, lastS(BX)
+
+// h = sum of the lanes of h, written to OFF(AX).
+#define SUM_LANES(X, OFF) \
+	MOVO   X, X10;    \
+	PSRLDQ $8, X10;   \
+	PADDQ  X10, X;    \
+	MOVQ   X, R8;     \
+	MOVL   R8, OFF(AX)
+
+// func blocksSSE2(h *[5]uint32, m []byte, t *[5][4]uint32)
+//
+// h is the partially reduced accumulator, which is updated with the
+// partially reduced result.  len(m) must be a non-zero multiple of 32, and
+// t[j][0] and t[j][1] must be limb j of r^2 and r^1.
+TEXT ·blocksSSE2(SB), 0, $304-40
+	MOVQ h+0(FP), AX
+	MOVQ m_base+8(FP), SI
+	MOVQ m_len+16(FP), CX
+	MOVQ t+32(FP), DX
+	SHRQ $5, CX
+
+	// The tables are accessed as memory operands, which must be aligned.
+	LEAQ 15(SP), BX
+	ANDQ $~15, BX
+
+	PCMPEQL X12, X12
+	MOVO    X12, X13
+	PSRLQ   $63, X13
+	PSLLQ   $24, X13
+	PSRLQ   $38, X12
+
+	POWERS(0, 0, 144)
+	POWERS_S(1, 16, 80, 160, 224)
+	POWERS_S(2, 32, 96, 176, 240)
+	POWERS_S(3, 48, 112, 192, 256)
+	POWERS_S(4, 64, 128, 208, 272)
+
+	// h goes in lane 0, the other lane starts at 0.
+	MOVL 0(AX), R8
+	MOVQ R8, X0
+	MOVL 4(AX), R8
+	MOVQ R8, X1
+	MOVL 8(AX), R8
+	MOVQ R8, X2
+	MOVL 12(AX), R8
+	MOVQ R8, X3
+	MOVL 16(AX), R8
+	MOVQ R8, X4
+
+	DECQ CX
+	JZ   last
+
+loop:
+	ADD_MESSAGE
+	MUL(0(BX), 16(BX), 32(BX), 48(BX), 64(BX), 80(BX), 96(BX), 112(BX), 128(BX))
+	CARRY
+	DECQ CX
+	JNZ  loop
+
+last:
+	ADD_MESSAGE
+	MUL(144(BX), 160(BX), 176(BX), 192(BX), 208(BX), 224(BX), 240(BX), 256(BX), 272(BX))
+	CARRY
+
+	SUM_LANES(X0, 0)
+	SUM_LANES(X1, 4)
+	SUM_LANES(X2, 8)
+	SUM_LANES(X3, 12)
+	SUM_LANES(X4, 16)
+
+	// Purge the powers of r from the stack and the registers.
+	PXOR X0, X0
+	MOVQ $0, CX
+
+purge:
+	MOVO X0, 0(BX)(CX*1)
+	ADDQ $16, CX
+	CMPQ CX, $288
+	JNE  purge
+
+	PXOR X10, X10
+	PXOR X11, X11
+	PXOR X14, X14
+	PXOR X15, X15
+	RET
@@ -10,12 +10,18 @@ package poly1305
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"testing"
+	"testing/iotest"
 )
 
 // Shamelessly stolen from poly1305-donna.c:poly1305_power_on_self_test()
 
 func TestNaCl(t *testing.T) {
+	disableReuseDetector(t)
+
 	var naclKey = []byte{
 		0xee, 0xa6, 0xa7, 0x25, 0x1c, 0x1e, 0x72, 0x91,
 		0x6d, 0x11, 0xc2, 0xcb, 0x21, 0x4d, 0x3c, 0x25,
@@ -126,6 +132,8 @@ func TestWrap(t *testing.T) {
 }
 
 func TestTotal(t *testing.T) {
+	disableReuseDetector(t)
+
 	// mac of the macs of messages of length 0 to 256, where the key and messages
 	// have all their values set to the length
 	totalKey := []byte{
@@ -174,6 +182,8 @@ func TestTotal(t *testing.T) {
 }
 
 func TestIETFDraft(t *testing.T) {
+	disableReuseDetector(t)
+
 	// Test vectors taken from:
 	// https://www.ietf.org/id/draft-irtf-cfrg-chacha20-poly1305-07.txt
 
@@ -546,13 +556,464 @@ func TestIETFDraft(t *testing.T) {
 	}
 }
 
-func TestIETFDraftForceByteswap(t *testing.T) {
-	if !isLittleEndian {
-		t.Skipf("not little endian, slow path already taken")
-	} else {
-		isLittleEndian = false
-		TestIETFDraft(t)
-		isLittleEndian = true
+func TestImplementations(t *testing.T) {
+	disableReuseDetector(t)
+	defer func(impl *implementation) {
+		activeImpl.Store(impl)
+	}(activeImpl.Load())
+
+	for _, impl := range implementations {
+		activeImpl.Store(impl)
+		t.Run(impl.name, func(t *testing.T) {
+			if !impl.supported {
+				t.Skipf("%s is not supported by the host", impl.name)
+			}
+			t.Run("NaCl", TestNaCl)
+			t.Run("Wrap", TestWrap)
+			t.Run("Total", TestTotal)
+			t.Run("IETFDraft", TestIETFDraft)
+		})
+	}
+}
+
+func TestClone(t *testing.T) {
+	disableReuseDetector(t)
+
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	prefix := make([]byte, 37)
+	for i := range prefix {
+		prefix[i] = byte(0xa5 ^ i)
+	}
+
+	h, err := New(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write(prefix)
+
+	for i, suffix := range [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("exactly sixteen!"),
+		bytes.Repeat([]byte{0xff}, 83),
+	} {
+		c, err := h.Clone()
+		if err != nil {
+			t.Fatalf("[%d]: h.Clone(): %s", i, err)
+		}
+		c.Write(suffix)
+
+		var expected [Size]byte
+		Sum(&expected, append(append([]byte{}, prefix...), suffix...), &key)
+		if mac := c.Sum(nil); !bytes.Equal(mac, expected[:]) {
+			t.Errorf("[%d]: clone mac != Sum(prefix || suffix)", i)
+		}
+	}
+
+	// None of the writes to the clones may leak into the original.
+	var expected [Size]byte
+	Sum(&expected, prefix, &key)
+	if mac := h.Sum(nil); !bytes.Equal(mac, expected[:]) {
+		t.Fatalf("mac != Sum(prefix)")
+	}
+}
+
+func TestFinalize(t *testing.T) {
+	disableReuseDetector(t)
+
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(i * 3)
+	}
+	m := []byte("finalize-once semantics")
+
+	h, err := New(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write(m)
+
+	var expected, mac [Size]byte
+	Sum(&expected, m, &key)
+	if err = h.Finalize(&mac); err != nil {
+		t.Fatalf("h.Finalize(): %s", err)
+	} else if mac != expected {
+		t.Fatalf("mac != Sum(m)")
+	}
+	if h.impl != (implState{}) || h.buffer != [BlockSize]byte{} || h.leftover != 0 {
+		t.Fatalf("h.Finalize() did not purge the state")
+	}
+
+	if n, err := h.Write(m); err != ErrFinalized || n != 0 {
+		t.Errorf("h.Write(): %d, %v (expected: 0, ErrFinalized)", n, err)
+	}
+	if err = h.Finalize(&mac); err != ErrFinalized {
+		t.Errorf("h.Finalize(): %v (expected: ErrFinalized)", err)
+	}
+	if _, err = h.Clone(); err != ErrFinalized {
+		t.Errorf("h.Clone(): %v (expected: ErrFinalized)", err)
+	}
+	if _, err = h.MarshalBinary(); err != ErrFinalized {
+		t.Errorf("h.MarshalBinary(): %v (expected: ErrFinalized)", err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != ErrFinalized {
+				t.Errorf("h.Sum(): recovered %v (expected: ErrFinalized)", r)
+			}
+		}()
+		h.Sum(nil)
+	}()
+
+	// Re-keying makes the instance usable again.
+	h.Init(key[:])
+	h.Write(m)
+	if mac := h.Sum(nil); !bytes.Equal(mac, expected[:]) {
+		t.Errorf("mac after Init() != Sum(m)")
+	}
+}
+
+func TestReset(t *testing.T) {
+	disableReuseDetector(t)
+
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(i + 0x40)
+	}
+	m := []byte("pooled hash.Hash instance")
+
+	// The default instances still refuse to be reset.
+	h, err := New(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("h.Reset() did not panic")
+			}
+		}()
+		h.Reset()
+	}()
+
+	h, err = NewResettable(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write(m)
+	h.Reset()
+	if h.impl != (implState{}) {
+		t.Fatalf("h.Reset() did not purge the state")
+	}
+
+	if n, err := h.Write(m); err != ErrNotKeyed || n != 0 {
+		t.Errorf("h.Write(): %d, %v (expected: 0, ErrNotKeyed)", n, err)
+	}
+	var mac [Size]byte
+	if err = h.Finalize(&mac); err != ErrNotKeyed {
+		t.Errorf("h.Finalize(): %v (expected: ErrNotKeyed)", err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != ErrNotKeyed {
+				t.Errorf("h.Sum(): recovered %v (expected: ErrNotKeyed)", r)
+			}
+		}()
+		h.Sum(nil)
+	}()
+
+	if err = h.Rekey(key[:KeySize-1]); err != ErrInvalidKeySize {
+		t.Errorf("h.Rekey(short key): %v (expected: ErrInvalidKeySize)", err)
+	} else if _, err = h.Write(m); err != ErrNotKeyed {
+		t.Errorf("h.Write() after failed Rekey(): %v (expected: ErrNotKeyed)", err)
+	}
+
+	if err = h.Rekey(key[:]); err != nil {
+		t.Fatalf("h.Rekey(): %s", err)
+	}
+	h.Write(m)
+	var expected [Size]byte
+	Sum(&expected, m, &key)
+	if mac := h.Sum(nil); !bytes.Equal(mac, expected[:]) {
+		t.Errorf("mac after Rekey() != Sum(m)")
+	}
+
+	// Finalized resettable instances may be returned to a pool as well.
+	h.Finalize(&mac)
+	h.Reset()
+	if _, err = h.Write(m); err != ErrNotKeyed {
+		t.Errorf("h.Write() after Finalize(), Reset(): %v (expected: ErrNotKeyed)", err)
+	}
+}
+
+func TestSumToVerify(t *testing.T) {
+	disableReuseDetector(t)
+
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(i * 5)
+	}
+	m := []byte("constant time, allocation free")
+
+	h, err := New(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write(m)
+
+	var expected, mac [Size]byte
+	Sum(&expected, m, &key)
+	h.SumTo(&mac)
+	if mac != expected {
+		t.Fatalf("h.SumTo() != Sum(m)")
+	}
+	if !h.Verify(mac[:]) {
+		t.Errorf("h.Verify(mac) returned false")
+	}
+	if err = h.VerifyTag(mac[:]); err != nil {
+		t.Errorf("h.VerifyTag(mac): %s", err)
+	}
+
+	mac[Size-1] ^= 0x80
+	if h.Verify(mac[:]) {
+		t.Errorf("h.Verify(corrupted mac) returned true")
+	}
+	if err = h.VerifyTag(mac[:]); err != ErrMacMismatch {
+		t.Errorf("h.VerifyTag(corrupted mac): %v (expected: ErrMacMismatch)", err)
+	}
+	for _, sz := range []int{0, Size - 1, Size + 1} {
+		tag := make([]byte, sz)
+		copy(tag, expected[:])
+		if h.Verify(tag) {
+			t.Errorf("h.Verify(%d byte tag) returned true", sz)
+		}
+		if err = h.VerifyTag(tag); err != ErrInvalidMacSize {
+			t.Errorf("h.VerifyTag(%d byte tag): %v (expected: ErrInvalidMacSize)", sz, err)
+		}
+	}
+
+	// None of the above may have altered the running state.
+	if mac := h.Sum(nil); !bytes.Equal(mac, expected[:]) {
+		t.Fatalf("h.Sum() != Sum(m)")
+	}
+}
+
+func TestSumToVerifyAllocs(t *testing.T) {
+	disableReuseDetector(t)
+
+	var key [KeySize]byte
+	h, err := New(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("allocation free"))
+
+	var mac [Size]byte
+	h.SumTo(&mac)
+	short := mac[:Size-1]
+	for _, vec := range []struct {
+		name string
+		fn   func()
+	}{
+		{"SumTo", func() { h.SumTo(&mac) }},
+		{"Verify", func() { h.Verify(mac[:]) }},
+		{"Verify (short)", func() { h.Verify(short) }},
+		{"VerifyTag", func() { h.VerifyTag(mac[:]) }},
+	} {
+		if n := testing.AllocsPerRun(100, vec.fn); n != 0 {
+			t.Errorf("%s: %v allocations (expected: 0)", vec.name, n)
+		}
+	}
+}
+
+func TestSumShort(t *testing.T) {
+	disableReuseDetector(t)
+	defer func(impl *implementation) {
+		activeImpl.Store(impl)
+	}(activeImpl.Load())
+
+	m := make([]byte, shortMessageSize+1)
+	for _, impl := range implementations {
+		activeImpl.Store(impl)
+		t.Run(impl.name, func(t *testing.T) {
+			if !impl.supported {
+				t.Skipf("%s is not supported by the host", impl.name)
+			}
+
+			for i := 0; i <= len(m); i++ {
+				var key [KeySize]byte
+				for j := range key {
+					key[j] = byte(i*7 + j*13)
+				}
+				msg := m[:i]
+				for j := range msg {
+					msg[j] = byte(0xff - i - j)
+				}
+
+				h, err := New(key[:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				h.Write(msg)
+				var expected, mac [Size]byte
+				h.SumTo(&expected)
+
+				Sum(&mac, msg, &key)
+				if mac != expected {
+					t.Fatalf("[%d]: Sum() != h.SumTo()", i)
+				}
+				if !Verify(&mac, msg, &key) {
+					t.Fatalf("[%d]: Verify(mac) returned false", i)
+				}
+				mac[i%Size] ^= 0x01
+				if Verify(&mac, msg, &key) {
+					t.Fatalf("[%d]: Verify(corrupted mac) returned true", i)
+				}
+			}
+		})
+	}
+}
+
+func TestSumShortAllocs(t *testing.T) {
+	// The key reuse detector allocates.
+	disableReuseDetector(t)
+
+	var key [KeySize]byte
+	var mac [Size]byte
+	m := make([]byte, shortMessageSize)
+	for _, vec := range []struct {
+		name string
+		fn   func()
+	}{
+		{"Sum", func() { Sum(&mac, m, &key) }},
+		{"Verify", func() { Verify(&mac, m, &key) }},
+	} {
+		if n := testing.AllocsPerRun(100, vec.fn); n != 0 {
+			t.Errorf("%s: %v allocations (expected: 0)", vec.name, n)
+		}
+	}
+}
+
+func TestWriteVectors(t *testing.T) {
+	disableReuseDetector(t)
+
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(0x10 + i)
+	}
+	m := make([]byte, 211)
+	for i := range m {
+		m[i] = byte(i * 13)
+	}
+	var expected [Size]byte
+	Sum(&expected, m, &key)
+
+	for i, splits := range [][]int{
+		{},
+		{0},
+		{1, 2, 3},
+		{13, 29, 32, 48, 50, 200, 210},
+		{16, 32, 48, 64},
+		{7, 7, 7, 150},
+	} {
+		var bufs [][]byte
+		prev := 0
+		for _, off := range splits {
+			bufs = append(bufs, m[prev:off])
+			prev = off
+		}
+		bufs = append(bufs, m[prev:])
+
+		h, _ := New(key[:])
+		n, err := h.WriteVectors(bufs)
+		if err != nil {
+			t.Fatalf("[%d]: h.WriteVectors(): %s", i, err)
+		} else if n != int64(len(m)) {
+			t.Fatalf("[%d]: h.WriteVectors(): %d (expected: %d)", i, n, len(m))
+		}
+		if mac := h.Sum(nil); !bytes.Equal(mac, expected[:]) {
+			t.Errorf("[%d]: mac != Sum(m)", i)
+		}
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	disableReuseDetector(t)
+
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(0x20 + i)
+	}
+	m := make([]byte, 3*readFromBufferSize+37)
+	for i := range m {
+		m[i] = byte(i * 17)
+	}
+	var expected [Size]byte
+	Sum(&expected, m, &key)
+
+	for _, vec := range []struct {
+		name   string
+		prefix int
+		r      func(io.Reader) io.Reader
+	}{
+		{"plain", 0, func(r io.Reader) io.Reader { return r }},
+		{"leftover", 5, func(r io.Reader) io.Reader { return r }},
+		{"one byte", 3, iotest.OneByteReader},
+		{"half", 16, iotest.HalfReader},
+		{"data err", 1, iotest.DataErrReader},
+	} {
+		h, _ := New(key[:])
+		h.Write(m[:vec.prefix])
+		n, err := h.ReadFrom(vec.r(bytes.NewReader(m[vec.prefix:])))
+		if err != nil {
+			t.Fatalf("%s: h.ReadFrom(): %s", vec.name, err)
+		} else if n != int64(len(m)-vec.prefix) {
+			t.Fatalf("%s: h.ReadFrom(): %d (expected: %d)", vec.name, n, len(m)-vec.prefix)
+		}
+		if mac := h.Sum(nil); !bytes.Equal(mac, expected[:]) {
+			t.Errorf("%s: mac != Sum(m)", vec.name)
+		}
+	}
+
+	// io.Copy uses ReadFrom.
+	h, _ := New(key[:])
+	if _, err := io.Copy(h, struct{ io.Reader }{bytes.NewReader(m)}); err != nil {
+		t.Fatalf("io.Copy(): %s", err)
+	} else if mac := h.Sum(nil); !bytes.Equal(mac, expected[:]) {
+		t.Errorf("io.Copy: mac != Sum(m)")
+	}
+
+	// Data read before an error is still hashed.
+	errTest := errors.New("test error")
+	h, _ = New(key[:])
+	n, err := h.ReadFrom(io.MultiReader(bytes.NewReader(m[:1000]), iotest.ErrReader(errTest)))
+	if err != errTest || n != 1000 {
+		t.Fatalf("h.ReadFrom(): %d, %v (expected: 1000, errTest)", n, err)
+	}
+	h.Write(m[1000:])
+	if mac := h.Sum(nil); !bytes.Equal(mac, expected[:]) {
+		t.Errorf("error: mac != Sum(m)")
+	}
+
+	// The leftover is wiped once it has been copied out.
+	h, _ = New(key[:])
+	h.Write(m[:13])
+	h.ReadFrom(bytes.NewReader(m[13:16]))
+	if h.leftover != 0 || h.buffer != [BlockSize]byte{} {
+		t.Errorf("h.ReadFrom(): leftover not wiped")
+	}
+
+	// Short readers do not allocate a buffer each.
+	r := bytes.NewReader(nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(m[:5])
+		h.ReadFrom(r)
+	})
+	if allocs != 0 {
+		t.Errorf("h.ReadFrom(): %v allocs (expected: 0)", allocs)
 	}
 }
 
@@ -583,3 +1044,97 @@ func Benchmark1k(b *testing.B) {
 		Sum(&mac, m, &key)
 	}
 }
+
+func BenchmarkSumShort(b *testing.B) {
+	var mac [Size]byte
+	var key [KeySize]byte
+	m := make([]byte, shortMessageSize)
+	for n := 0; n <= shortMessageSize; n++ {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				Sum(&mac, m[:n], &key)
+			}
+		})
+	}
+}
+
+// benchmarkVectors returns a header, body and trailer, and the body split
+// into many small unaligned pieces.
+func benchmarkVectors(small bool) (*Poly1305, [][]byte, int64) {
+	var key [KeySize]byte
+	h, _ := New(key[:])
+
+	bufs := [][]byte{make([]byte, 13), make([]byte, 1000), make([]byte, 7)}
+	if small {
+		bufs = bufs[:0]
+		for _, n := range []int{5, 13, 3, 40, 7, 24, 11, 9} {
+			for i := 0; i < 9; i++ {
+				bufs = append(bufs, make([]byte, n))
+			}
+		}
+	}
+
+	var n int64
+	for _, buf := range bufs {
+		n += int64(len(buf))
+	}
+	return h, bufs, n
+}
+
+func BenchmarkWriteLoop(b *testing.B) {
+	for _, small := range []bool{false, true} {
+		b.Run(fmt.Sprintf("small=%v", small), func(b *testing.B) {
+			h, bufs, n := benchmarkVectors(small)
+			b.SetBytes(n)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				for _, buf := range bufs {
+					h.Write(buf)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteVectors(b *testing.B) {
+	for _, small := range []bool{false, true} {
+		b.Run(fmt.Sprintf("small=%v", small), func(b *testing.B) {
+			h, bufs, n := benchmarkVectors(small)
+			b.SetBytes(n)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				h.WriteVectors(bufs)
+			}
+		})
+	}
+}
+
+func benchmarkReader(b *testing.B, copyFn func(h *Poly1305, r io.Reader)) {
+	var key [KeySize]byte
+	h, _ := New(key[:])
+	m := make([]byte, 1024*1024)
+	r := bytes.NewReader(m)
+	b.SetBytes(int64(len(m)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.Reset(m)
+		copyFn(h, r)
+	}
+}
+
+func BenchmarkCopyWrite(b *testing.B) {
+	buf := make([]byte, readFromBufferSize)
+	benchmarkReader(b, func(h *Poly1305, r io.Reader) {
+		io.CopyBuffer(struct{ io.Writer }{h}, struct{ io.Reader }{r}, buf)
+	})
+}
+
+func BenchmarkReadFrom(b *testing.B) {
+	benchmarkReader(b, func(h *Poly1305, r io.Reader) {
+		h.ReadFrom(struct{ io.Reader }{r})
+	})
+}
@@ -0,0 +1,34 @@
+//
+// purego_test.go: purego build tag tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"go/build"
+	"testing"
+)
+
+func TestPuregoNoUnsafe(t *testing.T) {
+	ctx := build.Default
+	ctx.BuildTags = append(ctx.BuildTags, "purego")
+
+	for _, dir := range []string{".", "field", "internal/field"} {
+		pkg, err := ctx.ImportDir(dir, 0)
+		if err != nil {
+			t.Fatalf("[%s]: ImportDir(): %s", dir, err)
+		}
+		for _, imp := range pkg.Imports {
+			if imp == "unsafe" {
+				t.Errorf("[%s]: purego build imports unsafe", dir)
+			}
+		}
+		if len(pkg.SFiles) != 0 {
+			t.Errorf("[%s]: purego build includes assembly: %v", dir, pkg.SFiles)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+//
+// reuse.go: One-time key reuse detector.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultReuseDetectorMemory is the default memory limit of the key
+	// reuse detector in bytes.
+	DefaultReuseDetectorMemory = 1 << 20
+
+	// DefaultReuseDetectorFalsePositiveRate is the default false positive
+	// rate of the key reuse detector.
+	DefaultReuseDetectorFalsePositiveRate = 1e-6
+
+	reuseRoleTag    = 't'
+	reuseRoleVerify = 'v'
+)
+
+var (
+	// ErrKeyReuse is the value the key reuse detector panic()s with when it
+	// encounters a previously seen key, and no hook is configured.
+	ErrKeyReuse = errors.New("poly1305: one-time key reuse detected")
+
+	// ErrInvalidDetectorConfig is the error returned when the key reuse
+	// detector configuration is invalid.
+	ErrInvalidDetectorConfig = errors.New("poly1305: invalid reuse detector configuration")
+
+	activeReuseDetector atomic.Pointer[reuseDetector]
+)
+
+// ReuseDetectorConfig is the key reuse detector configuration.
+type ReuseDetectorConfig struct {
+	// MaxMemory is the size of the detector's filter in bytes, or 0 for
+	// DefaultReuseDetectorMemory.
+	MaxMemory int
+
+	// FalsePositiveRate is the probability that a fresh key is reported as
+	// reused when the filter is at capacity, or 0 for
+	// DefaultReuseDetectorFalsePositiveRate.
+	FalsePositiveRate float64
+
+	// OnReuse, if set, is called when key reuse is detected instead of
+	// panic()ing with ErrKeyReuse.
+	OnReuse func()
+}
+
+// EnableReuseDetector enables the one-time key reuse detector, replacing the
+// existing detector if any.  While enabled, a keyed fingerprint of every key
+// passed to Init, Rekey, New, NewResettable, NewLocked, Sum and Verify, or
+// restored by UnmarshalBinary, is recorded, and encountering a fingerprint
+// twice is reported.  Keys used to
+// generate tags and keys used with Verify are tracked separately, so that
+// generating and verifying a tag in the same process is not reported.
+//
+// Fingerprints are stored in a Bloom filter sized by cfg (nil for the
+// defaults).  The filter is cleared once it reaches the capacity that
+// maintains the false positive rate, so reuse is only detected among
+// recently used keys.  The detector is intended for debugging, and adds
+// considerable overhead to every keying operation.
+func EnableReuseDetector(cfg *ReuseDetectorConfig) error {
+	var c ReuseDetectorConfig
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.MaxMemory == 0 {
+		c.MaxMemory = DefaultReuseDetectorMemory
+	}
+	if c.FalsePositiveRate == 0 {
+		c.FalsePositiveRate = DefaultReuseDetectorFalsePositiveRate
+	}
+	if c.MaxMemory < 8 || !(c.FalsePositiveRate > 0 && c.FalsePositiveRate < 1) {
+		return ErrInvalidDetectorConfig
+	}
+
+	// Optimal number of hash functions, and the capacity at which the
+	// target false positive rate is reached.
+	nBits := float64(c.MaxMemory/8) * 64
+	k := int(math.Ceil(-math.Log2(c.FalsePositiveRate)))
+	capacity := int(nBits * math.Ln2 * math.Ln2 / -math.Log(c.FalsePositiveRate))
+	if capacity < 1 {
+		return ErrInvalidDetectorConfig
+	}
+
+	d := &reuseDetector{
+		bits:     make([]uint64, c.MaxMemory/8),
+		k:        k,
+		capacity: capacity,
+		onReuse:  c.OnReuse,
+	}
+	if _, err := rand.Read(d.fingerprintKey[:]); err != nil {
+		return err
+	}
+	activeReuseDetector.Store(d)
+	return nil
+}
+
+// DisableReuseDetector disables the one-time key reuse detector.
+func DisableReuseDetector() {
+	activeReuseDetector.Store(nil)
+}
+
+type reuseDetector struct {
+	sync.Mutex
+
+	fingerprintKey [32]byte
+	bits           []uint64
+	k              int
+	n              int
+	capacity       int
+	onReuse        func()
+}
+
+func checkKeyReuse(role byte, key []byte) {
+	if d := activeReuseDetector.Load(); d != nil {
+		d.check(role, key)
+	}
+}
+
+func (d *reuseDetector) check(role byte, key []byte) {
+	// Keys are fingerprinted with r clamped, so that keys that only differ
+	// in the clamped bits, and serialized states (which only hold the
+	// clamped r) are recognized as the same key.
+	var clamped [KeySize]byte
+	copy(clamped[:], key)
+	r0 := binary.LittleEndian.Uint64(clamped[0:]) & 0x0ffffffc0fffffff
+	r1 := binary.LittleEndian.Uint64(clamped[8:]) & 0x0ffffffc0ffffffc
+	binary.LittleEndian.PutUint64(clamped[0:], r0)
+	binary.LittleEndian.PutUint64(clamped[8:], r1)
+
+	var fingerprint [sha256.Size]byte
+	mac := hmac.New(sha256.New, d.fingerprintKey[:])
+	mac.Write([]byte{role})
+	mac.Write(clamped[:])
+	mac.Sum(fingerprint[:0])
+	burnBytes(clamped[:])
+
+	// Kirsch-Mitzenmacher double hashing.
+	h1 := binary.LittleEndian.Uint64(fingerprint[0:])
+	h2 := binary.LittleEndian.Uint64(fingerprint[8:]) | 1
+	nBits := uint64(len(d.bits)) * 64
+
+	d.Lock()
+	if d.n >= d.capacity {
+		for i := range d.bits {
+			d.bits[i] = 0
+		}
+		d.n = 0
+	}
+	seen := true
+	for i := 0; i < d.k; i++ {
+		idx := (h1 + uint64(i)*h2) % nBits
+		if d.bits[idx/64]&(1<<(idx%64)) == 0 {
+			d.bits[idx/64] |= 1 << (idx % 64)
+			seen = false
+		}
+	}
+	if !seen {
+		d.n++
+	}
+	d.Unlock()
+
+	if seen {
+		if d.onReuse == nil {
+			panic(ErrKeyReuse)
+		}
+		d.onReuse()
+	}
+}
@@ -0,0 +1,19 @@
+//
+// reuse_debug.go: Build tag enabled one-time key reuse detector.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+//go:build poly1305_reusecheck
+
+package poly1305
+
+// Building with the poly1305_reusecheck tag enables the key reuse detector
+// with the default configuration on startup.
+func init() {
+	if err := EnableReuseDetector(nil); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,41 @@
+//
+// reuse_debug_test.go: Build tag enabled key reuse detector tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+//go:build poly1305_reusecheck
+
+package poly1305
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestReuseCheckBuildTag(t *testing.T) {
+	d := activeReuseDetector.Load()
+	if d == nil {
+		t.Fatalf("the build tag did not enable the detector")
+	}
+	if len(d.bits) != DefaultReuseDetectorMemory/8 || d.onReuse != nil {
+		t.Fatalf("the build tag did not use the default configuration")
+	}
+
+	var key [KeySize]byte
+	var mac [Size]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	Sum(&mac, nil, &key)
+	func() {
+		defer func() {
+			if r := recover(); r != ErrKeyReuse {
+				t.Errorf("Sum (same key): recovered %v (expected: ErrKeyReuse)", r)
+			}
+		}()
+		Sum(&mac, nil, &key)
+	}()
+}
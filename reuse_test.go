@@ -0,0 +1,139 @@
+//
+// reuse_test.go: One-time key reuse detector tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// disableReuseDetector disables the key reuse detector (eg: the build
+// tag's) until the end of a test that deliberately reuses keys.
+func disableReuseDetector(t testing.TB) {
+	d := activeReuseDetector.Load()
+	activeReuseDetector.Store(nil)
+	t.Cleanup(func() { activeReuseDetector.Store(d) })
+}
+
+func TestReuseDetector(t *testing.T) {
+	// Restore whichever detector was active, eg: the build tag's.
+	defer activeReuseDetector.Store(activeReuseDetector.Load())
+
+	var reused int
+	if err := EnableReuseDetector(&ReuseDetectorConfig{
+		MaxMemory: 4096,
+		OnReuse:   func() { reused++ },
+	}); err != nil {
+		t.Fatalf("EnableReuseDetector(): %s", err)
+	}
+
+	requireReused := func(op string, expected int) {
+		t.Helper()
+		if reused != expected {
+			t.Fatalf("%s: reuse reported %d times (expected: %d)", op, reused, expected)
+		}
+	}
+
+	var key [KeySize]byte
+	var mac [Size]byte
+	m := []byte("attack at dawn")
+
+	key[0] = 1
+	h, _ := New(key[:])
+	requireReused("New", 0)
+	h.Init(key[:])
+	requireReused("Init (same key)", 1)
+
+	key[0] = 2
+	Sum(&mac, m, &key)
+	requireReused("Sum", 1)
+	if !Verify(&mac, m, &key) {
+		t.Fatalf("Verify() returned false")
+	}
+	requireReused("Verify (tag key)", 1)
+	Verify(&mac, m, &key)
+	requireReused("Verify (same key)", 2)
+	Sum(&mac, m, &key)
+	requireReused("Sum (same key)", 3)
+
+	key[0] = 3
+	if err := h.Rekey(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	requireReused("Rekey", 3)
+	if _, err := NewResettable(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	requireReused("NewResettable (same key)", 4)
+
+	// Restoring a serialized state uses its key, which only holds the
+	// clamped r.
+	key[0], key[3] = 4, 0xff
+	h, _ = New(key[:])
+	b, _ := h.MarshalBinary()
+	requireReused("New (unclamped)", 4)
+	var h2 Poly1305
+	if err := h2.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	requireReused("UnmarshalBinary (same key)", 5)
+
+	// Fresh keys are never reported, well below capacity.
+	for i := 0; i < 100; i++ {
+		binary.LittleEndian.PutUint64(key[16:], uint64(i+1))
+		Sum(&mac, m, &key)
+	}
+	requireReused("Sum (fresh keys)", 5)
+
+	// Without a hook, the detector panic()s.
+	if err := EnableReuseDetector(nil); err != nil {
+		t.Fatalf("EnableReuseDetector(nil): %s", err)
+	}
+	Sum(&mac, m, &key)
+	func() {
+		defer func() {
+			if r := recover(); r != ErrKeyReuse {
+				t.Errorf("Sum (same key): recovered %v (expected: ErrKeyReuse)", r)
+			}
+		}()
+		Sum(&mac, m, &key)
+	}()
+}
+
+func TestReuseDetectorCapacity(t *testing.T) {
+	defer activeReuseDetector.Store(activeReuseDetector.Load())
+	if err := EnableReuseDetector(&ReuseDetectorConfig{MaxMemory: 8, FalsePositiveRate: 0.5}); err != nil {
+		t.Fatalf("EnableReuseDetector(): %s", err)
+	}
+
+	d := activeReuseDetector.Load()
+	var key [KeySize]byte
+	for i := 0; i < 10*d.capacity; i++ {
+		binary.LittleEndian.PutUint64(key[:], uint64(i))
+		func() {
+			// At this false positive rate collisions are expected.
+			defer func() { recover() }()
+			checkKeyReuse(reuseRoleTag, key[:])
+		}()
+		if d.n > d.capacity {
+			t.Fatalf("filter exceeded capacity: %d > %d", d.n, d.capacity)
+		}
+	}
+
+	for i, cfg := range []ReuseDetectorConfig{
+		{MaxMemory: -1},
+		{MaxMemory: 4},
+		{FalsePositiveRate: -0.1},
+		{FalsePositiveRate: 1},
+	} {
+		if err := EnableReuseDetector(&cfg); err != ErrInvalidDetectorConfig {
+			t.Errorf("[%d]: EnableReuseDetector(): %v (expected: ErrInvalidDetectorConfig)", i, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+//
+// rolling.go: Keyed rolling Poly1305 hash and content-defined chunking.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"errors"
+	"io"
+
+	"github.com/Yawning/poly1305/internal/field"
+)
+
+// ErrInvalidChunkerConfig is the error returned when a Rolling window or
+// Chunker configuration is invalid.
+var ErrInvalidChunkerConfig = errors.New("poly1305: invalid rolling hash or chunker configuration")
+
+// Rolling is a keyed rolling hash, that is the Poly1305 MAC of the last
+// window blocks added to it.
+//
+// With c_1 .. c_W being the blocks in the window (oldest first), the
+// accumulator is h = c_1 * r^W + ... + c_W * r, so adding c and evicting c_1
+// is h' = (h + c - c_1 * r^W) * r.
+type Rolling struct {
+	impl   implState
+	rW     field.Element
+	window []field.Element
+	pos    int
+}
+
+// NewRolling returns a new Rolling over window blocks, keyed with the
+// supplied key.
+func NewRolling(key []byte, window int) (*Rolling, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKeySize
+	}
+	if window <= 0 {
+		return nil, ErrInvalidChunkerConfig
+	}
+	if err := checkSelfTest(); err != nil {
+		return nil, err
+	}
+	checkKeyReuse(reuseRoleTag, key)
+
+	rh := &Rolling{
+		window: make([]field.Element, window),
+	}
+	rh.impl.init(key)
+	rh.rW.Pow(&rh.impl.r, uint64(window))
+	return rh, nil
+}
+
+// Roll adds a block to the head of the window, evicting the block at the
+// tail.  Blocks shorter than BlockSize are padded as the final block of a
+// Poly1305 message is.  It panic()s with ErrInvalidBlock if the block is
+// longer than BlockSize.
+func (rh *Rolling) Roll(block []byte) {
+	if len(block) > BlockSize {
+		panic(ErrInvalidBlock)
+	}
+
+	var evicted field.Element
+	c := blockElement(block)
+	evicted.Mul(&rh.window[rh.pos], &rh.rW)
+	h := &rh.impl.h
+	h.Add(h, &c).Sub(h, &evicted).Mul(h, &rh.impl.r)
+
+	rh.window[rh.pos] = c
+	if rh.pos++; rh.pos == len(rh.window) {
+		rh.pos = 0
+	}
+}
+
+// SumTo writes the digest of the window to out.  Once the window is full of
+// BlockSize blocks, the digest is the Poly1305 MAC of those blocks.
+func (rh *Rolling) SumTo(out *[Size]byte) {
+	impl := rh.impl
+	impl.finish(out)
+	impl.clear()
+}
+
+// Sum64 returns the first 8 bytes of the digest of the window, as a little
+// endian integer.  Unlike SumTo, it does not finalize a copy of the state,
+// and only needs the low 64 bits of the reduced accumulator, so it is cheap
+// enough to call after every Roll.
+func (rh *Rolling) Sum64() uint64 {
+	// (h + pad) % 2^128, truncated to 64 bits.
+	h0, _, _ := load64(&rh.impl.h)
+	return h0 + (uint64(rh.impl.pad[0]) | uint64(rh.impl.pad[1])<<32)
+}
+
+// Reset empties the window, retaining the key.
+func (rh *Rolling) Reset() {
+	for i := range rh.window {
+		rh.window[i].Zero()
+	}
+	rh.impl.h.Zero()
+	rh.pos = 0
+}
+
+// Clear purges the sensitive material in the state.
+func (rh *Rolling) Clear() {
+	rh.Reset()
+	rh.impl.clear()
+	rh.rW.Zero()
+}
+
+// ChunkerConfig is the Chunker configuration.
+type ChunkerConfig struct {
+	// MinSize, AvgSize and MaxSize bound the size of the chunks, with chunk
+	// boundaries placed where the low log2(AvgSize) bits of the digest are
+	// 0, so chunks are on average roughly MinSize + AvgSize bytes long.
+	// AvgSize must be a power of two.
+	MinSize, AvgSize, MaxSize int
+
+	// Window is the number of bytes in the rolling hash window.  The
+	// rolling hash is byte granular, with each byte added as a block of its
+	// own, so that a boundary can follow any byte, which is what keeps the
+	// boundaries stable when data is inserted or removed.
+	Window int
+}
+
+// DefaultChunkerConfig is the default Chunker configuration.
+var DefaultChunkerConfig = ChunkerConfig{
+	MinSize: 2 * 1024,
+	AvgSize: 8 * 1024,
+	MaxSize: 64 * 1024,
+	Window:  64,
+}
+
+// Chunker splits a stream into content-defined chunks, with boundaries that
+// are derived from a keyed rolling hash over each byte, so that the chunk
+// boundaries do not reveal the structure of the stream to those that do not
+// know the key.  Every byte costs a field multiply and a Sum64, see
+// ChunkerConfig.
+type Chunker struct {
+	r    io.Reader
+	rh   *Rolling
+	cfg  ChunkerConfig
+	mask uint64
+
+	// in[b] and out[b] are the byte b as a block, and times r^Window, so
+	// that rolling a byte in and another out only takes a multiply by r.
+	in, out [256]field.Element
+
+	buf        []byte
+	start, end int
+	err        error
+}
+
+// NewChunker returns a new Chunker reading from r, keyed with the supplied
+// key, using cfg (nil for DefaultChunkerConfig).
+func NewChunker(r io.Reader, key []byte, cfg *ChunkerConfig) (*Chunker, error) {
+	if cfg == nil {
+		cfg = &DefaultChunkerConfig
+	}
+	c := *cfg
+	if c.MinSize < c.Window || c.AvgSize <= 0 || c.AvgSize&(c.AvgSize-1) != 0 || c.MaxSize < c.MinSize {
+		return nil, ErrInvalidChunkerConfig
+	}
+	rh, err := NewRolling(key, c.Window)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := &Chunker{
+		r:    r,
+		rh:   rh,
+		cfg:  c,
+		mask: uint64(c.AvgSize - 1),
+		buf:  make([]byte, c.MaxSize),
+	}
+	for i := range ch.in {
+		ch.in[i] = blockElement([]byte{byte(i)})
+		ch.out[i].Mul(&ch.in[i], &rh.rW)
+	}
+	return ch, nil
+}
+
+// Next returns the next chunk, which is only valid until the next call to
+// Next.  Once the stream is exhausted, it returns io.EOF, or the error
+// encountered while reading the stream.
+func (c *Chunker) Next() ([]byte, error) {
+	// Refill the buffer, so that up to MaxSize bytes are available.
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for c.end < len(c.buf) && c.err == nil {
+		var n int
+		n, c.err = c.r.Read(c.buf[c.end:])
+		c.end += n
+	}
+	if c.end == 0 {
+		return nil, c.err
+	}
+
+	// Only the last Window bytes before MinSize can influence the first
+	// candidate boundary, so skip hashing everything before that.  This is
+	// Roll with one byte at a time, with the window being the bytes in buf.
+	n := c.end
+	if n > c.cfg.MinSize {
+		h, r := &c.rh.impl.h, &c.rh.impl.r
+		h.Zero()
+		for i := c.cfg.MinSize - c.cfg.Window; i < n; i++ {
+			h.Add(h, &c.in[c.buf[i]])
+			if i >= c.cfg.MinSize {
+				h.Sub(h, &c.out[c.buf[i-c.cfg.Window]])
+			}
+			h.Mul(h, r)
+			if i+1 >= c.cfg.MinSize && c.rh.Sum64()&c.mask == 0 {
+				n = i + 1
+				break
+			}
+		}
+	}
+
+	c.start = n
+	return c.buf[:n], nil
+}
+
+// Clear purges the sensitive material in the state.
+func (c *Chunker) Clear() {
+	c.rh.Clear()
+	for i := range c.in {
+		c.in[i].Zero()
+		c.out[i].Zero()
+	}
+	burnBytes(c.buf)
+}
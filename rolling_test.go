@@ -0,0 +1,207 @@
+//
+// rolling_test.go: Keyed rolling hash and chunker tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+	"testing"
+	"testing/iotest"
+)
+
+func TestRolling(t *testing.T) {
+	disableReuseDetector(t)
+
+	const window = 5
+
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(0x33 * i)
+	}
+	m := make([]byte, 20*BlockSize)
+	for i := range m {
+		m[i] = byte(i*i + 1)
+	}
+
+	rh, err := NewRolling(key[:], window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(m)/BlockSize; i++ {
+		rh.Roll(m[i*BlockSize : (i+1)*BlockSize])
+
+		// The digest is the MAC of the blocks in the window.
+		start := max(0, i+1-window) * BlockSize
+		var expected, mac [Size]byte
+		Sum(&expected, m[start:(i+1)*BlockSize], &key)
+		rh.SumTo(&mac)
+		if mac != expected {
+			t.Fatalf("[%d]: digest != Sum(window)", i)
+		}
+		if v := rh.Sum64(); v != binary.LittleEndian.Uint64(expected[:]) {
+			t.Fatalf("[%d]: Sum64() != Sum(window)[:8]", i)
+		}
+	}
+
+	rh.Reset()
+	var expected, mac [Size]byte
+	Sum(&expected, nil, &key)
+	rh.SumTo(&mac)
+	if mac != expected {
+		t.Fatalf("digest after Reset() != Sum(nil)")
+	}
+
+	// A partial block is padded like the final block of a message.
+	rh.Roll(m[:3])
+	Sum(&expected, m[:3], &key)
+	rh.SumTo(&mac)
+	if mac != expected {
+		t.Fatalf("partial block digest != Sum(block)")
+	}
+
+	if _, err = NewRolling(key[:], 0); err != ErrInvalidChunkerConfig {
+		t.Errorf("NewRolling(0): %v (expected: ErrInvalidChunkerConfig)", err)
+	}
+}
+
+func chunkAll(t *testing.T, r io.Reader, key []byte, cfg *ChunkerConfig) [][]byte {
+	c, err := NewChunker(r, key, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		} else if err != nil {
+			t.Fatalf("c.Next(): %s", err)
+		}
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	disableReuseDetector(t)
+
+	cfg := &ChunkerConfig{MinSize: 256, AvgSize: 512, MaxSize: 2048, Window: 32}
+
+	rng := rand.New(rand.NewPCG(1305, 13))
+	m := make([]byte, 64*1024)
+	for i := range m {
+		m[i] = byte(rng.Uint32())
+	}
+	var key [KeySize]byte
+	key[0] = 1
+
+	chunks := chunkAll(t, iotest.HalfReader(bytes.NewReader(m)), key[:], cfg)
+	if !bytes.Equal(bytes.Join(chunks, nil), m) {
+		t.Fatalf("chunks do not reassemble the stream")
+	}
+
+	// The boundaries are those of the full digest of a Rolling over the
+	// bytes since MinSize - Window.
+	rh, _ := NewRolling(key[:], cfg.Window)
+	off := 0
+	for i, chunk := range chunks {
+		expected := min(len(m)-off, cfg.MaxSize)
+		rh.Reset()
+		for j := cfg.MinSize - cfg.Window; j < expected; j++ {
+			rh.Roll(m[off+j : off+j+1])
+			var mac [Size]byte
+			rh.SumTo(&mac)
+			if j+1 >= cfg.MinSize && binary.LittleEndian.Uint64(mac[:])&uint64(cfg.AvgSize-1) == 0 {
+				expected = j + 1
+				break
+			}
+		}
+		if len(chunk) != expected {
+			t.Fatalf("[%d]: chunk size %d (expected: %d)", i, len(chunk), expected)
+		}
+		off += len(chunk)
+	}
+	boundaries := make(map[int]bool)
+	off = 0
+	for i, chunk := range chunks {
+		if len(chunk) > cfg.MaxSize || (len(chunk) < cfg.MinSize && i != len(chunks)-1) {
+			t.Errorf("[%d]: chunk size %d out of bounds", i, len(chunk))
+		}
+		off += len(chunk)
+		boundaries[off] = true
+	}
+	if n := len(m) / len(chunks); n < cfg.MinSize || n > cfg.MinSize+2*cfg.AvgSize {
+		t.Errorf("average chunk size %d far from target", n)
+	}
+
+	// Boundaries are content defined, so inserting data at the start only
+	// disturbs the first few chunks.
+	shifted := chunkAll(t, bytes.NewReader(append([]byte("inserted"), m...)), key[:], cfg)
+	preserved := 0
+	off = -len("inserted")
+	for _, chunk := range shifted {
+		off += len(chunk)
+		if boundaries[off] {
+			preserved++
+		}
+	}
+	if preserved < len(chunks)*9/10 {
+		t.Errorf("only %d of %d boundaries preserved after an insertion", preserved, len(chunks))
+	}
+
+	// Boundaries depend on the key.
+	key[0] = 2
+	other := chunkAll(t, bytes.NewReader(m), key[:], cfg)
+	same := 0
+	off = 0
+	for _, chunk := range other[:len(other)-1] {
+		off += len(chunk)
+		if boundaries[off] {
+			same++
+		}
+	}
+	if same > len(chunks)/4 {
+		t.Errorf("%d of %d boundaries shared with a different key", same, len(chunks))
+	}
+
+	for i, bad := range []ChunkerConfig{
+		{MinSize: 16, AvgSize: 512, MaxSize: 2048, Window: 32},
+		{MinSize: 256, AvgSize: 500, MaxSize: 2048, Window: 32},
+		{MinSize: 256, AvgSize: 512, MaxSize: 128, Window: 32},
+		{MinSize: 256, AvgSize: 512, MaxSize: 2048, Window: 0},
+	} {
+		if _, err := NewChunker(bytes.NewReader(m), key[:], &bad); err != ErrInvalidChunkerConfig {
+			t.Errorf("[%d]: NewChunker(): %v (expected: ErrInvalidChunkerConfig)", i, err)
+		}
+	}
+}
+
+func BenchmarkChunker(b *testing.B) {
+	rng := rand.New(rand.NewPCG(1305, 13))
+	m := make([]byte, 1024*1024)
+	for i := range m {
+		m[i] = byte(rng.Uint32())
+	}
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(rng.Uint32())
+	}
+	b.SetBytes(int64(len(m)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c, _ := NewChunker(bytes.NewReader(m), key[:], nil)
+		for {
+			if _, err := c.Next(); err != nil {
+				break
+			}
+		}
+	}
+}
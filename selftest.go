@@ -0,0 +1,268 @@
+//
+// selftest.go: Poly1305 power-on self test.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// envSelfTest is the environment variable that enables the lazy self-test
+// on startup, see EnableSelfTestOnFirstUse.
+const envSelfTest = "POLY1305_SELFTEST"
+
+var (
+	// ErrSelfTestFailed is the error returned (wrapped) by SelfTest when a
+	// backend fails a known answer test.
+	ErrSelfTestFailed = errors.New("poly1305: self-test failed")
+
+	selfTestOnFirstUse atomic.Bool
+	selfTestOnce       sync.Once
+	selfTestErr        error
+)
+
+// Shamelessly stolen from poly1305-donna.c:poly1305_power_on_self_test(),
+// and the IETF draft.
+var selfTestVectors = []struct {
+	name string
+	key  [KeySize]byte
+	m    []byte
+	mac  [Size]byte
+}{
+	{
+		"nacl",
+		[KeySize]byte{
+			0xee, 0xa6, 0xa7, 0x25, 0x1c, 0x1e, 0x72, 0x91,
+			0x6d, 0x11, 0xc2, 0xcb, 0x21, 0x4d, 0x3c, 0x25,
+			0x25, 0x39, 0x12, 0x1d, 0x8e, 0x23, 0x4e, 0x65,
+			0x2d, 0x65, 0x1f, 0xa4, 0xc8, 0xcf, 0xf8, 0x80,
+		},
+		[]byte{
+			0x8e, 0x99, 0x3b, 0x9f, 0x48, 0x68, 0x12, 0x73,
+			0xc2, 0x96, 0x50, 0xba, 0x32, 0xfc, 0x76, 0xce,
+			0x48, 0x33, 0x2e, 0xa7, 0x16, 0x4d, 0x96, 0xa4,
+			0x47, 0x6f, 0xb8, 0xc5, 0x31, 0xa1, 0x18, 0x6a,
+			0xc0, 0xdf, 0xc1, 0x7c, 0x98, 0xdc, 0xe8, 0x7b,
+			0x4d, 0xa7, 0xf0, 0x11, 0xec, 0x48, 0xc9, 0x72,
+			0x71, 0xd2, 0xc2, 0x0f, 0x9b, 0x92, 0x8f, 0xe2,
+			0x27, 0x0d, 0x6f, 0xb8, 0x63, 0xd5, 0x17, 0x38,
+			0xb4, 0x8e, 0xee, 0xe3, 0x14, 0xa7, 0xcc, 0x8a,
+			0xb9, 0x32, 0x16, 0x45, 0x48, 0xe5, 0x26, 0xae,
+			0x90, 0x22, 0x43, 0x68, 0x51, 0x7a, 0xcf, 0xea,
+			0xbd, 0x6b, 0xb3, 0x73, 0x2b, 0xc0, 0xe9, 0xda,
+			0x99, 0x83, 0x2b, 0x61, 0xca, 0x01, 0xb6, 0xde,
+			0x56, 0x24, 0x4a, 0x9e, 0x88, 0xd5, 0xf9, 0xb3,
+			0x79, 0x73, 0xf6, 0x22, 0xa4, 0x3d, 0x14, 0xa6,
+			0x59, 0x9b, 0x1f, 0x65, 0x4c, 0xb4, 0x5a, 0x74,
+			0xe3, 0x55, 0xa5,
+		},
+		[Size]byte{
+			0xf3, 0xff, 0xc7, 0x70, 0x3f, 0x94, 0x00, 0xe5,
+			0x2a, 0x7d, 0xfb, 0x4b, 0x3d, 0x33, 0x05, 0xd9,
+		},
+	},
+
+	// generates a final value of (2^130 - 2) == 3
+	{
+		"wrap",
+		[KeySize]byte{
+			0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		},
+		[]byte{
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		},
+		[Size]byte{
+			0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		},
+	},
+
+	// 5*H+L-type reduction producing a 131-bit intermediate result (IETF
+	// draft test vector #10).
+	{
+		"131-bit intermediate",
+		[KeySize]byte{
+			0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		},
+		[]byte{
+			0xe3, 0x35, 0x94, 0xd7, 0x50, 0x5e, 0x43, 0xb9,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x33, 0x94, 0xd7, 0x50, 0x5e, 0x43, 0x79, 0xcd,
+			0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		},
+		[Size]byte{
+			0x14, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x55, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		},
+	},
+
+	// 5*H+L-type reduction producing a 131-bit final result (IETF draft
+	// test vector #11).
+	{
+		"131-bit final",
+		[KeySize]byte{
+			0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		},
+		[]byte{
+			0xe3, 0x35, 0x94, 0xd7, 0x50, 0x5e, 0x43, 0xb9,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x33, 0x94, 0xd7, 0x50, 0x5e, 0x43, 0x79, 0xcd,
+			0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		},
+		[Size]byte{
+			0x13, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		},
+	},
+}
+
+// mac of the macs of messages of length 0 to 255, where the key and
+// messages have all their values set to the length
+var (
+	selfTestTotalKey = [KeySize]byte{
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+		0xff, 0xfe, 0xfd, 0xfc, 0xfb, 0xfa, 0xf9,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x00, 0x00, 0x00, 0x00,
+	}
+
+	selfTestTotalMac = [Size]byte{
+		0x64, 0xaf, 0xe2, 0xe8, 0xd6, 0xad, 0x7b, 0xbd,
+		0xd2, 0x87, 0xf9, 0x7c, 0x44, 0x62, 0x3d, 0x39,
+	}
+)
+
+// SelfTest runs the poly1305-donna known answer tests (the NaCl vector, the
+// wrap case, the 131-bit reduction edge cases, and the mac of the macs of
+// 256 messages) against every backend supported by the host, through both
+// the generic blocks code path, and the dedicated one-shot path for short
+// messages.  The buffering in Write is not exercised.  It returns an error
+// wrapping ErrSelfTestFailed that names the first backend and test to fail,
+// if any.  The key reuse detector and the cross-check mode are bypassed.
+func SelfTest() error {
+	for _, impl := range implementations {
+		if !impl.supported {
+			continue
+		}
+
+		for _, vec := range selfTestVectors {
+			if !selfTestVector(impl, &vec.key, vec.m, &vec.mac) {
+				return fmt.Errorf("%w: %s: %s", ErrSelfTestFailed, impl.name, vec.name)
+			}
+		}
+		if !selfTestTotal(impl) {
+			return fmt.Errorf("%w: %s: total", ErrSelfTestFailed, impl.name)
+		}
+	}
+	return nil
+}
+
+// EnableSelfTestOnFirstUse makes the first call to any of the entry points
+// below run SelfTest, once per process.  If the self-test fails, they all
+// refuse to run from then on:
+//
+//   - New, NewResettable, NewLocked, NewPartial, NewPatchable, NewRolling,
+//     Rekey, UnmarshalBinary, UnmarshalSealed, SumTruncated and
+//     VerifyTruncated return the error.
+//   - Init, Sum, Verify, SumBatch, VerifyBatch and SumParallel panic() with
+//     it.
+//
+// Instances keyed before the self-test ran are not affected.  The
+// POLY1305_SELFTEST environment variable does the same on startup.
+func EnableSelfTestOnFirstUse() {
+	selfTestOnFirstUse.Store(true)
+}
+
+// checkSelfTest returns the result of the lazy self-test, running it if
+// needed, or nil if it is not enabled.
+func checkSelfTest() error {
+	if !selfTestOnFirstUse.Load() {
+		return nil
+	}
+
+	selfTestOnce.Do(func() {
+		selfTestErr = SelfTest()
+	})
+	return selfTestErr
+}
+
+// requireSelfTest panic()s with the result of the lazy self-test, if it
+// failed, see checkSelfTest.
+func requireSelfTest() {
+	if err := checkSelfTest(); err != nil {
+		panic(err)
+	}
+}
+
+// selfTestVector returns true iff m has the expected mac under key, with
+// the given backend.
+func selfTestVector(which *implementation, key *[KeySize]byte, m []byte, expected *[Size]byte) bool {
+	var mac [Size]byte
+	sumWith(which, &mac, m, key)
+	ok := mac == *expected
+	if len(m) <= shortMessageSize {
+		sumShortWith(which, &mac, m, key)
+		ok = ok && mac == *expected
+	}
+	return ok
+}
+
+func selfTestTotal(which *implementation) bool {
+	var key [KeySize]byte
+	msg := make([]byte, 255)
+	macs := make([]byte, 256*Size)
+
+	for i := 0; i < 256; i++ {
+		// set key and message to 'i,i,i..'
+		for j := range key {
+			key[j] = byte(i)
+		}
+		for j := 0; j < i; j++ {
+			msg[j] = byte(i)
+		}
+
+		mac := (*[Size]byte)(macs[i*Size:])
+		if i <= shortMessageSize {
+			sumShortWith(which, mac, msg[:i], &key)
+		} else {
+			sumWith(which, mac, msg[:i], &key)
+		}
+	}
+
+	// The macs are long enough for the multi-block backends.
+	var mac [Size]byte
+	sumWith(which, &mac, macs, &selfTestTotalKey)
+	return mac == selfTestTotalMac
+}
+
+func init() {
+	if os.Getenv(envSelfTest) != "" {
+		EnableSelfTestOnFirstUse()
+	}
+}
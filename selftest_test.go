@@ -0,0 +1,101 @@
+//
+// selftest_test.go: Poly1305 power-on self test tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// corruptSelfTest breaks the wrap vector's expected mac, and returns a
+// function that undoes it, and resets the lazy self-test.
+func corruptSelfTest() func() {
+	vec := &selfTestVectors[1]
+	vec.mac[0] ^= 0x01
+	return func() {
+		vec.mac[0] ^= 0x01
+		selfTestOnFirstUse.Store(false)
+		selfTestOnce = sync.Once{}
+		selfTestErr = nil
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Fatalf("SelfTest(): %s", err)
+	}
+
+	defer corruptSelfTest()()
+	err := SelfTest()
+	if !errors.Is(err, ErrSelfTestFailed) {
+		t.Fatalf("SelfTest(corrupted): %v (expected: ErrSelfTestFailed)", err)
+	}
+	if !strings.HasSuffix(err.Error(), ": donna32: wrap") {
+		t.Errorf("SelfTest(corrupted): %s (expected the first backend, and the wrap test)", err)
+	}
+}
+
+func TestSelfTestOnFirstUse(t *testing.T) {
+	disableReuseDetector(t)
+
+	var key [KeySize]byte
+	var mac [Size]byte
+	state, err := New(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := state.MarshalBinary()
+
+	defer corruptSelfTest()()
+	EnableSelfTestOnFirstUse()
+
+	var h Poly1305
+	tag := make([]byte, Size)
+	for _, vec := range []struct {
+		name string
+		fn   func() error
+	}{
+		{"New", func() error { _, err := New(key[:]); return err }},
+		{"NewResettable", func() error { _, err := NewResettable(key[:]); return err }},
+		{"NewLocked", func() error { _, err := NewLocked(key[:]); return err }},
+		{"NewPartial", func() error { _, err := NewPartial(key[:]); return err }},
+		{"NewPatchable", func() error { _, err := NewPatchable(key[:], nil); return err }},
+		{"NewRolling", func() error { _, err := NewRolling(key[:], 1); return err }},
+		{"Rekey", func() error { return h.Rekey(key[:]) }},
+		{"SumTruncated", func() error { return SumTruncated(tag, nil, &key) }},
+		{"VerifyTruncated", func() error { return VerifyTruncated(tag, nil, &key) }},
+		{"UnmarshalBinary", func() error { return h.UnmarshalBinary(b) }},
+	} {
+		if err := vec.fn(); !errors.Is(err, ErrSelfTestFailed) {
+			t.Errorf("%s: %v (expected: ErrSelfTestFailed)", vec.name, err)
+		}
+	}
+	for _, vec := range []struct {
+		name string
+		fn   func()
+	}{
+		{"Init", func() { h.Init(key[:]) }},
+		{"Sum", func() { Sum(&mac, nil, &key) }},
+		{"Verify", func() { Verify(&mac, nil, &key) }},
+		{"SumBatch", func() { SumBatch([]*[Size]byte{&mac}, [][]byte{nil}, []*[KeySize]byte{&key}) }},
+		{"VerifyBatch", func() { VerifyBatch([]*[Size]byte{&mac}, [][]byte{nil}, []*[KeySize]byte{&key}) }},
+		{"SumParallel", func() { SumParallel(&mac, nil, &key, 0) }},
+	} {
+		func() {
+			defer func() {
+				if err, _ := recover().(error); !errors.Is(err, ErrSelfTestFailed) {
+					t.Errorf("%s: recovered %v (expected: ErrSelfTestFailed)", vec.name, err)
+				}
+			}()
+			vec.fn()
+		}()
+	}
+}
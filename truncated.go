@@ -0,0 +1,107 @@
+//
+// truncated.go: Truncated Poly1305 tags.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrInvalidMessageSize is the error returned by SecurityLevel for negative
+// message lengths.
+var ErrInvalidMessageSize = errors.New("poly1305: invalid message size")
+
+// SumTruncated computes the MAC of m under key, truncated to len(out) bytes,
+// which must be 8, 12 or Size, and writes it to out.  It returns
+// ErrInvalidMacSize for any other length, without touching out.
+func SumTruncated(out, m []byte, key *[KeySize]byte) error {
+	if !validTagSize(len(out)) {
+		return ErrInvalidMacSize
+	}
+	if err := checkSelfTest(); err != nil {
+		return err
+	}
+	checkKeyReuse(reuseRoleTag, key[:])
+
+	var mac [Size]byte
+	sumOneShot(&mac, m, key)
+	copy(out, mac[:])
+	mac = [Size]byte{}
+	return nil
+}
+
+// VerifyTruncated checks that tag is the MAC of m under key, truncated to
+// len(tag) bytes, in constant time.  It returns ErrInvalidMacSize if tag is
+// not 8, 12 or Size bytes, and ErrMacMismatch if it does not match.
+func VerifyTruncated(tag, m []byte, key *[KeySize]byte) error {
+	if !validTagSize(len(tag)) {
+		return ErrInvalidMacSize
+	}
+	if err := checkSelfTest(); err != nil {
+		return err
+	}
+	checkKeyReuse(reuseRoleVerify, key[:])
+
+	var mac [Size]byte
+	sumOneShot(&mac, m, key)
+	if !compareMAC(tag, &mac) {
+		return ErrMacMismatch
+	}
+	return nil
+}
+
+// SetTagSize sets the length of the tags returned by Sum and accepted by
+// Verify and VerifyTag to size bytes, which must be 8, 12 or Size (the
+// default), and returns ErrInvalidMacSize for any other length.  Truncated
+// tags are the prefix of the full MAC, which SumTo and Finalize still write
+// in full.  The tag size is kept across Init, Rekey and Reset, and is part
+// of the serialized state.
+func (st *Poly1305) SetTagSize(size int) error {
+	if !validTagSize(size) {
+		return ErrInvalidMacSize
+	}
+	st.tagSize = size
+	return nil
+}
+
+// SecurityLevel returns the security level in bits of tags of tagSize bytes
+// (8, 12 or Size) for messages of up to msgLen bytes, against a single
+// forgery attempt, or ErrInvalidMacSize or ErrInvalidMessageSize if either
+// is out of range.  The Poly1305 forgery probability is at most
+// 8 * ceil(L/16) / 2^106 for full tags, and 2^(128 - t) times that for tags
+// truncated to t bits, for a security level of
+//
+//	t - 25 - log2(ceil(L/16))
+//
+// bits, at least 0.  An attacker making q forgery attempts gets q times
+// the probability, so log2(q) must be subtracted from the result.  For
+// example, 8 byte tags on 1024 byte messages give 33 bits.
+func SecurityLevel(tagSize, msgLen int) (float64, error) {
+	if !validTagSize(tagSize) {
+		return 0, ErrInvalidMacSize
+	}
+	if msgLen < 0 {
+		return 0, ErrInvalidMessageSize
+	}
+
+	nBlocks := msgLen / BlockSize
+	if msgLen%BlockSize != 0 || nBlocks == 0 {
+		nBlocks++
+	}
+	bits := float64(tagSize*8) - 25 - math.Log2(float64(nBlocks))
+	return max(0, bits), nil
+}
+
+func validTagSize(size int) bool {
+	switch size {
+	case 8, 12, Size:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+//
+// truncated_test.go: Truncated Poly1305 tag tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+var invalidTagSizes = []int{0, 1, 7, 9, 11, 13, 15, 17, 32}
+
+func TestSumTruncated(t *testing.T) {
+	disableReuseDetector(t)
+
+	for i, vec := range selfTestVectors {
+		for _, sz := range []int{8, 12, Size} {
+			tag := make([]byte, sz)
+			if err := SumTruncated(tag, vec.m, &vec.key); err != nil {
+				t.Fatalf("[%d]: SumTruncated(%d): %s", i, sz, err)
+			}
+			if !bytes.Equal(tag, vec.mac[:sz]) {
+				t.Errorf("[%d]: SumTruncated(%d) != vec.mac[:%d]", i, sz, sz)
+			}
+
+			if err := VerifyTruncated(tag, vec.m, &vec.key); err != nil {
+				t.Errorf("[%d]: VerifyTruncated(%d): %s", i, sz, err)
+			}
+			tag[sz-1] ^= 0x80
+			if err := VerifyTruncated(tag, vec.m, &vec.key); err != ErrMacMismatch {
+				t.Errorf("[%d]: VerifyTruncated(%d, corrupted tag): %v (expected: ErrMacMismatch)", i, sz, err)
+			}
+		}
+	}
+
+	var key [KeySize]byte
+	for _, sz := range invalidTagSizes {
+		tag := make([]byte, sz)
+		if err := SumTruncated(tag, nil, &key); err != ErrInvalidMacSize {
+			t.Errorf("SumTruncated(%d): %v (expected: ErrInvalidMacSize)", sz, err)
+		}
+		if err := VerifyTruncated(tag, nil, &key); err != ErrInvalidMacSize {
+			t.Errorf("VerifyTruncated(%d): %v (expected: ErrInvalidMacSize)", sz, err)
+		}
+	}
+}
+
+func TestSetTagSize(t *testing.T) {
+	disableReuseDetector(t)
+
+	vec := selfTestVectors[0]
+
+	for _, sz := range []int{8, 12, Size} {
+		h, err := NewResettable(vec.key[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = h.SetTagSize(sz); err != nil {
+			t.Fatalf("SetTagSize(%d): %s", sz, err)
+		}
+		h.Write(vec.m)
+
+		if n := h.Size(); n != sz {
+			t.Errorf("SetTagSize(%d): Size() = %d", sz, n)
+		}
+		tag := h.Sum(nil)
+		if !bytes.Equal(tag, vec.mac[:sz]) {
+			t.Fatalf("SetTagSize(%d): Sum() != vec.mac[:%d]", sz, sz)
+		}
+		if !h.Verify(tag) {
+			t.Errorf("SetTagSize(%d): Verify(tag) returned false", sz)
+		}
+		if err = h.VerifyTag(vec.mac[:]); sz != Size && err != ErrInvalidMacSize {
+			t.Errorf("SetTagSize(%d): VerifyTag(full tag): %v (expected: ErrInvalidMacSize)", sz, err)
+		}
+		tag[0] ^= 0x01
+		if err = h.VerifyTag(tag); err != ErrMacMismatch {
+			t.Errorf("SetTagSize(%d): VerifyTag(corrupted tag): %v (expected: ErrMacMismatch)", sz, err)
+		}
+
+		var mac [Size]byte
+		h.SumTo(&mac)
+		if mac != vec.mac {
+			t.Errorf("SetTagSize(%d): SumTo() != vec.mac", sz)
+		}
+
+		// The tag size survives re-keying.
+		h.Reset()
+		h.Init(vec.key[:])
+		if n := h.Size(); n != sz {
+			t.Errorf("SetTagSize(%d): Size() after Reset = %d", sz, n)
+		}
+	}
+
+	h, err := New(vec.key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sz := range invalidTagSizes {
+		if err = h.SetTagSize(sz); err != ErrInvalidMacSize {
+			t.Errorf("SetTagSize(%d): %v (expected: ErrInvalidMacSize)", sz, err)
+		}
+	}
+	if n := h.Size(); n != Size {
+		t.Errorf("Size() after invalid SetTagSize = %d", n)
+	}
+}
+
+func TestSecurityLevel(t *testing.T) {
+	for i, vec := range []struct {
+		tagSize, msgLen int
+		bits            float64
+	}{
+		{Size, 0, 103},
+		{Size, 16, 103},
+		{Size, 17, 102},
+		{Size, 1024, 97},
+		{12, 64, 69},
+		{8, 1024, 33},
+		{8, 1 << 30, 13},
+	} {
+		bits, err := SecurityLevel(vec.tagSize, vec.msgLen)
+		if err != nil {
+			t.Fatalf("[%d]: SecurityLevel(%d, %d): %s", i, vec.tagSize, vec.msgLen, err)
+		}
+		if bits != vec.bits {
+			t.Errorf("[%d]: SecurityLevel(%d, %d) = %v (expected: %v)", i, vec.tagSize, vec.msgLen, bits, vec.bits)
+		}
+	}
+
+	// Long enough messages have no security left at all.
+	bits, _ := SecurityLevel(8, math.MaxInt)
+	if bits < 0 || (math.MaxInt > math.MaxInt32 && bits != 0) {
+		t.Errorf("SecurityLevel(8, MaxInt) = %v", bits)
+	}
+
+	for _, l := range []int{-1, -16, math.MinInt} {
+		if _, err := SecurityLevel(Size, l); err != ErrInvalidMessageSize {
+			t.Errorf("SecurityLevel(%d): %v (expected: ErrInvalidMessageSize)", l, err)
+		}
+	}
+
+	for _, sz := range invalidTagSizes {
+		if _, err := SecurityLevel(sz, 64); err != ErrInvalidMacSize {
+			t.Errorf("SecurityLevel(%d): %v (expected: ErrInvalidMacSize)", sz, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+//
+// wipe_test.go: Poly1305 sensitive material zeroization tests.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to poly1305, using the creative
+// commons "CC0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package poly1305
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// requireWiped inspects the raw memory backing every field of st that may
+// hold key, accumulator or message material, and fails if any of it is
+// non-zero.
+func requireWiped(t *testing.T, op string, st *Poly1305) {
+	t.Helper()
+
+	for _, f := range []struct {
+		name string
+		b    []byte
+	}{
+		{"impl", unsafe.Slice((*byte)(unsafe.Pointer(&st.impl)), unsafe.Sizeof(st.impl))},
+		{"leftover", unsafe.Slice((*byte)(unsafe.Pointer(&st.leftover)), unsafe.Sizeof(st.leftover))},
+		{"buffer", st.buffer[:]},
+	} {
+		for i, v := range f.b {
+			if v != 0 {
+				t.Fatalf("%s: %s not wiped (byte %d: 0x%02x)", op, f.name, i, v)
+			}
+		}
+	}
+}
+
+func TestWipe(t *testing.T) {
+	disableReuseDetector(t)
+
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(0xc0 | i)
+	}
+	m := make([]byte, 45) // Leaves a partial block buffered.
+	for i := range m {
+		m[i] = byte(0xff - i)
+	}
+
+	newDirty := func() *Poly1305 {
+		h, err := NewResettable(key[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Write(m)
+		if h.leftover == 0 {
+			t.Fatalf("test message does not leave a partial block")
+		}
+		return h
+	}
+
+	h := newDirty()
+	h.Clear()
+	requireWiped(t, "Clear", h)
+
+	h = newDirty()
+	h.Reset()
+	requireWiped(t, "Reset", h)
+
+	var mac [Size]byte
+	h = newDirty()
+	h.Finalize(&mac)
+	requireWiped(t, "Finalize", h)
+
+	h = newDirty()
+	h.finish(&mac)
+	requireWiped(t, "finish", h)
+
+	var tmp Poly1305
+	h = newDirty()
+	h.sum(&tmp, &mac)
+	requireWiped(t, "Sum (scratch)", &tmp)
+	if h.leftover == 0 {
+		t.Fatalf("Sum modified the underlying state")
+	}
+
+	// Re-keying must not leave the previous message tail around.
+	var zeroKey [KeySize]byte
+	h.Init(zeroKey[:])
+	requireWiped(t, "Init", h)
+
+	tmp = *newDirty()
+	sum(&tmp, &mac, m, &key)
+	requireWiped(t, "package Sum (scratch)", &tmp)
+
+	tmp = *newDirty()
+	if !verify(&tmp, &mac, m, &key) {
+		t.Fatalf("verify() returned false")
+	}
+	requireWiped(t, "package Verify (scratch)", &tmp)
+}